@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	s3AccessLogSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "access_log", "success"),
+		"If the new access logs were read",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3AccessLogTruncated = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "access_log", "truncated"),
+		"If the probe stopped early because it ran out of budget, leaving logs for the next probe",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3AccessLogObjects = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "access_log", "objects_total"),
+		"The number of access log objects read",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3AccessLogInvalidLines = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "access_log", "invalid_lines_total"),
+		"The number of lines in the access logs that couldn't be parsed",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3AccessLogLastObjectDate = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "access_log", "last_object_date"),
+		"The last modified date of the last access log object read",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3AccessLogRequests = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "access_log", "requests_total"),
+		"The number of requests in the access logs, by the bucket they were made to, operation and HTTP status",
+		[]string{"bucket", "prefix", "source_bucket", "operation", "status"}, nil,
+	)
+	s3AccessLogBytesSent = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "access_log", "bytes_sent_total"),
+		"The number of response bytes sent for the requests in the access logs, by the bucket they were made to, operation and HTTP status",
+		[]string{"bucket", "prefix", "source_bucket", "operation", "status"}, nil,
+	)
+	s3AccessLogRequesterRequests = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "access_log", "requester_requests_total"),
+		"The number of requests in the access logs, by the bucket they were made to and who made them",
+		[]string{"bucket", "prefix", "source_bucket", "requester"}, nil,
+	)
+	s3AccessLogRequesterBytesSent = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "access_log", "requester_bytes_sent_total"),
+		"The number of response bytes sent for the requests in the access logs, by the bucket they were made to and who made them",
+		[]string{"bucket", "prefix", "source_bucket", "requester"}, nil,
+	)
+)
+
+// otherRequesters is the requester label of requests from requesters over
+// max_requesters
+const otherRequesters = "other"
+
+// Layouts of the date at the start of access log keys, after the prefix
+const (
+	accessLogLayout            = "2006-01-02-15-04-05"
+	partitionedAccessLogLayout = "2006/01/02/2006-01-02-15-04-05"
+)
+
+// AccessLogConfig configures the accesslog prober, which counts the requests
+// in S3 server access logs. The bucket and prefix parameters are where the
+// logs are delivered to.
+type AccessLogConfig struct {
+	// Partitioned is for logs delivered with date-based partitioning. The
+	// prefix parameter then goes up to and including the source bucket's
+	// name.
+	Partitioned bool `yaml:"partitioned,omitempty"`
+	// Lookback is how far back the first probe starts reading from
+	Lookback model.Duration `yaml:"lookback,omitempty"`
+	// Delay is how old logs must be before they're read. S3 doesn't deliver
+	// logs in the order of their keys, so logs that turn up after this long
+	// are never counted.
+	Delay model.Duration `yaml:"delay,omitempty"`
+	// MaxRequesters is how many requesters get their own label. Requests
+	// from any more are counted together.
+	MaxRequesters int `yaml:"max_requesters,omitempty"`
+}
+
+// defaultAccessLogConfig is used for modules with the accesslog prober that
+// don't set anything
+var defaultAccessLogConfig = AccessLogConfig{
+	Lookback:      model.Duration(time.Hour),
+	Delay:         model.Duration(15 * time.Minute),
+	MaxRequesters: 100,
+}
+
+// UnmarshalYAML sets the defaults for an access log config and validates it
+func (c *AccessLogConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain AccessLogConfig
+	*c = defaultAccessLogConfig
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Lookback <= 0 {
+		return fmt.Errorf("line %d: lookback must be more than 0", value.Line)
+	}
+	if c.Delay < 0 {
+		return fmt.Errorf("line %d: delay can't be negative", value.Line)
+	}
+	if c.MaxRequesters < 0 {
+		return fmt.Errorf("line %d: max_requesters can't be negative", value.Line)
+	}
+	return nil
+}
+
+// keyAt returns the key of a log delivered under prefix at t
+func (c *AccessLogConfig) keyAt(prefix string, t time.Time) string {
+	layout := accessLogLayout
+	if c.Partitioned {
+		layout = partitionedAccessLogLayout
+	}
+	return prefix + t.UTC().Format(layout)
+}
+
+// accessLogRequest is the part of an access log line that's counted
+type accessLogRequest struct {
+	bucket    string
+	requester string
+	operation string
+	status    string
+	bytesSent int64
+}
+
+// parseAccessLogLine reads the fields of a line of a server access log, which
+// are separated by spaces. The time is in brackets and some fields are in
+// quotes, which can have spaces in them. New fields are added to the end of
+// the format from time to time, so any after the ones used are ignored.
+func parseAccessLogLine(line string) (*accessLogRequest, error) {
+	var fields []string
+	for len(fields) < 12 {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return nil, fmt.Errorf("expected at least 12 fields, got %d", len(fields))
+		}
+		end := 0
+		switch line[0] {
+		case '[':
+			end = strings.IndexByte(line, ']')
+		case '"':
+			end = 1
+			for end < len(line) && (line[end] != '"' || line[end-1] == '\\') {
+				end++
+			}
+			if end == len(line) {
+				end = -1
+			}
+		default:
+			end = strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+			end--
+		}
+		if end < 0 {
+			return nil, fmt.Errorf("field %d isn't closed", len(fields))
+		}
+		fields = append(fields, line[:end+1])
+		line = line[end+1:]
+	}
+
+	r := &accessLogRequest{
+		bucket:    fields[1],
+		requester: fields[4],
+		operation: fields[6],
+		status:    fields[9],
+	}
+	if _, err := strconv.Atoi(r.status); err != nil {
+		return nil, fmt.Errorf("invalid HTTP status %q", r.status)
+	}
+	if v := fields[11]; v != "-" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytes sent %q", v)
+		}
+		r.bytesSent = n
+	}
+	return r, nil
+}
+
+// accessLogCount is the requests and bytes sent for a combination of labels
+type accessLogCount struct {
+	SourceBucket string  `json:"source_bucket"`
+	Operation    string  `json:"operation,omitempty"`
+	Status       string  `json:"status,omitempty"`
+	Requester    string  `json:"requester,omitempty"`
+	Requests     float64 `json:"requests"`
+	BytesSent    float64 `json:"bytes_sent"`
+}
+
+// accessLogState is the totals of every access log read so far
+type accessLogState struct {
+	// LastKey is the key that the next probe reads after
+	LastKey      string    `json:"last_key"`
+	LastModified time.Time `json:"last_modified"`
+	Objects      float64   `json:"objects"`
+	InvalidLines float64   `json:"invalid_lines"`
+	// Requests are by source bucket, operation and status
+	Requests []accessLogCount `json:"requests"`
+	// Requesters are by source bucket and requester
+	Requesters []accessLogCount `json:"requesters"`
+}
+
+// accessLogTotals are the totals in an accessLogState, keyed by their labels
+type accessLogTotals struct {
+	requests   map[accessLogCount]*accessLogCount
+	requesters map[accessLogCount]*accessLogCount
+	// known counts the requesters with their own label
+	known int
+}
+
+// countKey is the labels of a count, without the numbers
+func countKey(c accessLogCount) accessLogCount {
+	c.Requests, c.BytesSent = 0, 0
+	return c
+}
+
+func newAccessLogTotals(s *accessLogState) *accessLogTotals {
+	t := &accessLogTotals{
+		requests:   map[accessLogCount]*accessLogCount{},
+		requesters: map[accessLogCount]*accessLogCount{},
+	}
+	for i := range s.Requests {
+		t.requests[countKey(s.Requests[i])] = &s.Requests[i]
+	}
+	for i := range s.Requesters {
+		t.requesters[countKey(s.Requesters[i])] = &s.Requesters[i]
+		if s.Requesters[i].Requester != otherRequesters {
+			t.known++
+		}
+	}
+	return t
+}
+
+// add counts a request
+func (t *accessLogTotals) add(r *accessLogRequest, maxRequesters int) {
+	byStatus := accessLogCount{SourceBucket: r.bucket, Operation: r.operation, Status: r.status}
+	byStatus.count(t.requests, r)
+
+	byRequester := accessLogCount{SourceBucket: r.bucket, Requester: r.requester}
+	if _, ok := t.requesters[byRequester]; !ok {
+		if t.known >= maxRequesters {
+			byRequester.Requester = otherRequesters
+		} else {
+			t.known++
+		}
+	}
+	byRequester.count(t.requesters, r)
+}
+
+// count adds a request to the count in m with the same labels as key
+func (key accessLogCount) count(m map[accessLogCount]*accessLogCount, r *accessLogRequest) {
+	c, ok := m[key]
+	if !ok {
+		c = &key
+		m[key] = c
+	}
+	c.Requests++
+	c.BytesSent = c.BytesSent + float64(r.bytesSent)
+}
+
+// counts returns the counts in m sorted by their labels, so that the state
+// is saved the same way each time
+func counts(m map[accessLogCount]*accessLogCount) []accessLogCount {
+	var all []accessLogCount
+	for _, c := range m {
+		all = append(all, *c)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if a.SourceBucket != b.SourceBucket {
+			return a.SourceBucket < b.SourceBucket
+		}
+		if a.Operation != b.Operation {
+			return a.Operation < b.Operation
+		}
+		if a.Status != b.Status {
+			return a.Status < b.Status
+		}
+		return a.Requester < b.Requester
+	})
+	return all
+}
+
+// accessLogResult is what a probe of the access logs found
+type accessLogResult struct {
+	state     *accessLogState
+	truncated bool
+}
+
+// readAccessLog reads an access log and adds its requests to the totals
+func (e *Exporter) readAccessLog(key string, s *accessLogState, t *accessLogTotals) error {
+	body, err := e.lister.Get(e.ctx, e.bucket, key, "")
+	if err != nil {
+		return fmt.Errorf("error getting access log %s: %s", key, err)
+	}
+	defer body.Close()
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		r, err := parseAccessLogLine(line)
+		if err != nil {
+			log.Debugf("Invalid line in access log %s: %s", key, err)
+			s.InvalidLines++
+			continue
+		}
+		t.add(r, e.module.AccessLog.MaxRequesters)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading access log %s: %s", key, err)
+	}
+	return nil
+}
+
+// accessLogs reads the logs delivered since the last one read by the probe
+// before and adds them to the totals so far. Logs that haven't been read
+// when the probe runs out of budget are left for the next probe.
+func (e *Exporter) accessLogs() (*accessLogResult, error) {
+	conf := e.module.AccessLog
+	store := e.totalsStore()
+	id := e.stateID() + "-accesslog"
+	defer lockState(id)()
+
+	s := &accessLogState{}
+	data, err := store.load(e.ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("error loading access log state: %s", err)
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, fmt.Errorf("error decoding access log state: %s", err)
+		}
+	}
+	totals := newAccessLogTotals(s)
+
+	now := time.Now()
+	startAfter := s.LastKey
+	if !strings.HasPrefix(startAfter, e.prefix) {
+		startAfter = conf.keyAt(e.prefix, now.Add(-time.Duration(conf.Lookback)))
+	}
+	endKey := conf.keyAt(e.prefix, now.Add(-time.Duration(conf.Delay)))
+
+	stop := func(o *objectInfo) bool { return o.Key > endKey }
+	truncated, err := e.tailObjects(startAfter, stop, func(o *objectInfo) error {
+		if err := e.readAccessLog(o.Key, s, totals); err != nil {
+			return err
+		}
+		s.LastKey = o.Key
+		s.LastModified = o.LastModified
+		s.Objects++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Requests = counts(totals.requests)
+	s.Requesters = counts(totals.requesters)
+	data, err = json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.save(e.ctx, id, data); err != nil {
+		return nil, fmt.Errorf("error saving access log state: %s", err)
+	}
+	return &accessLogResult{state: s, truncated: truncated}, nil
+}
+
+func (e *Exporter) describeAccessLog(ch chan<- *prometheus.Desc) {
+	ch <- s3AccessLogSuccess
+	ch <- s3AccessLogTruncated
+	ch <- s3AccessLogObjects
+	ch <- s3AccessLogInvalidLines
+	ch <- s3AccessLogLastObjectDate
+	ch <- s3AccessLogRequests
+	ch <- s3AccessLogBytesSent
+	ch <- s3AccessLogRequesterRequests
+	ch <- s3AccessLogRequesterBytesSent
+	if e.prefix != e.prefixLabel {
+		ch <- s3ResolvedPrefix
+	}
+}
+
+// collectAccessLog reads the new access logs and reports the totals
+func (e *Exporter) collectAccessLog(ch chan<- prometheus.Metric) {
+	if e.prefix != e.prefixLabel {
+		ch <- prometheus.MustNewConstMetric(
+			s3ResolvedPrefix, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel, e.prefix,
+		)
+	}
+
+	start := time.Now()
+	r, err := e.accessLogs()
+	observeProbe(e.moduleName, start, err == nil)
+	if err != nil {
+		log.Errorln(err)
+		ch <- prometheus.MustNewConstMetric(
+			s3AccessLogSuccess, prometheus.GaugeValue, 0, e.bucket, e.prefixLabel,
+		)
+		return
+	}
+
+	s := r.state
+	ch <- prometheus.MustNewConstMetric(
+		s3AccessLogSuccess, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3AccessLogTruncated, prometheus.GaugeValue, boolToFloat(r.truncated), e.bucket, e.prefixLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3AccessLogObjects, prometheus.CounterValue, s.Objects, e.bucket, e.prefixLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3AccessLogInvalidLines, prometheus.CounterValue, s.InvalidLines, e.bucket, e.prefixLabel,
+	)
+	if !s.LastModified.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			s3AccessLogLastObjectDate, prometheus.GaugeValue, float64(s.LastModified.Unix()), e.bucket, e.prefixLabel,
+		)
+	}
+	for _, c := range s.Requests {
+		ch <- prometheus.MustNewConstMetric(
+			s3AccessLogRequests, prometheus.CounterValue, c.Requests, e.bucket, e.prefixLabel, c.SourceBucket, c.Operation, c.Status,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			s3AccessLogBytesSent, prometheus.CounterValue, c.BytesSent, e.bucket, e.prefixLabel, c.SourceBucket, c.Operation, c.Status,
+		)
+	}
+	for _, c := range s.Requesters {
+		ch <- prometheus.MustNewConstMetric(
+			s3AccessLogRequesterRequests, prometheus.CounterValue, c.Requests, e.bucket, e.prefixLabel, c.SourceBucket, c.Requester,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			s3AccessLogRequesterBytesSent, prometheus.CounterValue, c.BytesSent, e.bucket, e.prefixLabel, c.SourceBucket, c.Requester,
+		)
+	}
+}
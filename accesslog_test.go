@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// TestParseAccessLogLine checks the fields read from access log lines, and
+// that lines with fields missing or invalid are rejected
+func TestParseAccessLogLine(t *testing.T) {
+	tests := map[string]*accessLogRequest{
+		// From the S3 documentation
+		`79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be DOC-EXAMPLE-BUCKET1 [06/Feb/2019:00:00:38 +0000] 192.0.2.3 79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be 3E57427F3EXAMPLE REST.GET.VERSIONING - "GET /DOC-EXAMPLE-BUCKET1?versioning HTTP/1.1" 200 - 113 - 7 - "-" "S3Console/0.4" - s9lzHYrFp76ZVxRcpX9+5cjAnEH2ROuNkd2BHfIa6UkFVdtjf5mKR3/eTPFvsiP/XV/VLi31234= SigV4 ECDHE-RSA-AES128-GCM-SHA256 AuthHeader DOC-EXAMPLE-BUCKET1.s3.us-west-1.amazonaws.com TLSV1.2 arn:aws:s3:us-west-1:123456789012:accesspoint/example-AP Yes`: {
+			bucket:    "DOC-EXAMPLE-BUCKET1",
+			requester: "79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be",
+			operation: "REST.GET.VERSIONING",
+			status:    "200",
+			bytesSent: 113,
+		},
+		// Spaces and an escaped quote in the request URI, and no bytes sent
+		`owner data [06/Feb/2019:00:00:38 +0000] 192.0.2.3 arn:aws:iam::123456789012:user/bob 3E57 REST.PUT.OBJECT a%20b "PUT /a b \" c HTTP/1.1" 403 AccessDenied - 10 7 - "-" "curl"`: {
+			bucket:    "data",
+			requester: "arn:aws:iam::123456789012:user/bob",
+			operation: "REST.PUT.OBJECT",
+			status:    "403",
+		},
+		`owner data [06/Feb/2019:00:00:38 +0000] 192.0.2.3 - 3E57 REST.GET.OBJECT a "GET /a HTTP/1.1" 200 -`:     nil,
+		`owner data [06/Feb/2019:00:00:38 +0000] 192.0.2.3 - 3E57 REST.GET.OBJECT a "GET /a HTTP/1.1 200 - 5 5`:  nil,
+		`owner data [06/Feb/2019:00:00:38 +0000] 192.0.2.3 - 3E57 REST.GET.OBJECT a "GET /a HTTP/1.1" OK - 5 5`:  nil,
+		`owner data [06/Feb/2019:00:00:38 +0000] 192.0.2.3 - 3E57 REST.GET.OBJECT a "GET /a HTTP/1.1" 200 - x 5`: nil,
+	}
+	for line, expected := range tests {
+		r, err := parseAccessLogLine(line)
+		if expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", line, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("%s: expected %+v, got %+v", line, expected, r)
+		}
+	}
+}
+
+// accessLogLine is a line of an access log for a request to the data bucket
+func accessLogLine(requester, operation string, status int, bytesSent string) string {
+	return fmt.Sprintf(`owner data [06/Feb/2019:00:00:38 +0000] 192.0.2.3 %s 3E57 %s key "GET /data/key HTTP/1.1" %d - %s 10 7 - "-" "curl"`+"\n", requester, operation, status, bytesSent)
+}
+
+// newAccessLogBucket has an access log under logs/ for each time, delivered
+// then, with the lines given
+func newAccessLogBucket(logs map[time.Time]string) *memS3Client {
+	svc := newMemS3Client(nil)
+	svc.bodies = map[string][]byte{}
+	var objects []*s3.Object
+	for modified, body := range logs {
+		key := "logs/" + modified.UTC().Format(accessLogLayout) + "-0123456789ABCDEF"
+		svc.bodies[key] = []byte(body)
+		objects = append(objects, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(body))),
+			LastModified: aws.Time(modified),
+		})
+	}
+	svc.objects = newMemS3Client(objects).objects
+	return svc
+}
+
+// TestProbeHandlerAccessLog checks that only logs in the lookback and older
+// than the delay are read, and that each is counted once, across probes and
+// after running out of budget. What a probe reports is in the accesslog
+// golden tests.
+func TestProbeHandlerAccessLog(t *testing.T) {
+	memoryState = newMemStateStore(defaultMemoryStateTargets)
+
+	conf, err := parseConfig([]byte(`
+modules:
+  logs:
+    prober: accesslog
+    access_log:
+      lookback: 6h
+      delay: 30m
+  budget:
+    prober: accesslog
+    max_objects: 1
+    access_log:
+      lookback: 6h
+      delay: 30m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	line := accessLogLine
+	alice := "arn:aws:iam::123456789012:user/alice"
+	bob := "arn:aws:iam::123456789012:user/bob"
+	logs := map[time.Duration]string{
+		// Before the lookback
+		-7 * time.Hour: line(alice, "REST.GET.OBJECT", 200, "1000"),
+		-5 * time.Hour: line(alice, "REST.GET.OBJECT", 200, "100") + line(alice, "REST.GET.OBJECT", 200, "50"),
+		-4 * time.Hour: line(bob, "REST.PUT.OBJECT", 403, "-") + "garbage\n\n",
+		// Not delivered until the second probe
+		-3 * time.Hour: line(bob, "REST.GET.OBJECT", 200, "10"),
+		// Too recent to read
+		-10 * time.Minute: line(bob, "REST.GET.OBJECT", 200, "10000"),
+	}
+	bucket := func(ages ...time.Duration) *memS3Client {
+		delivered := map[time.Time]string{}
+		for _, age := range ages {
+			delivered[now.Add(age)] = logs[age]
+		}
+		return newAccessLogBucket(delivered)
+	}
+	first := bucket(-7*time.Hour, -5*time.Hour, -4*time.Hour, -10*time.Minute)
+	second := bucket(-7*time.Hour, -5*time.Hour, -4*time.Hour, -3*time.Hour, -10*time.Minute)
+
+	labels := `bucket="logs",prefix="logs/"`
+	requests := func(operation string, status int) string {
+		return fmt.Sprintf(`{bucket="logs",operation="%s",prefix="logs/",source_bucket="data",status="%d"}`, operation, status)
+	}
+	requester := func(requester string) string {
+		return `{bucket="logs",prefix="logs/",requester="` + requester + `",source_bucket="data"}`
+	}
+	type step struct {
+		svc      *memS3Client
+		expected []string
+	}
+	tests := map[string][]step{
+		"logs": {
+			{
+				svc: first,
+				expected: []string{
+					`s3_access_log_objects_total{` + labels + `} 2`,
+					`s3_access_log_bytes_sent_total` + requests("REST.GET.OBJECT", 200) + ` 150`,
+					`s3_access_log_last_object_date{` + labels + `} ` + fmt.Sprintf("%g", float64(now.Add(-4*time.Hour).Unix())),
+				},
+			},
+			{
+				svc: second,
+				expected: []string{
+					`s3_access_log_objects_total{` + labels + `} 3`,
+					`s3_access_log_invalid_lines_total{` + labels + `} 1`,
+					`s3_access_log_requests_total` + requests("REST.GET.OBJECT", 200) + ` 3`,
+					`s3_access_log_bytes_sent_total` + requests("REST.GET.OBJECT", 200) + ` 160`,
+					`s3_access_log_requests_total` + requests("REST.PUT.OBJECT", 403) + ` 1`,
+					`s3_access_log_requester_requests_total` + requester(bob) + ` 2`,
+				},
+			},
+		},
+		"budget": {
+			{
+				svc: first,
+				expected: []string{
+					`s3_access_log_truncated{` + labels + `} 1`,
+					`s3_access_log_objects_total{` + labels + `} 1`,
+					`s3_access_log_requests_total` + requests("REST.GET.OBJECT", 200) + ` 2`,
+				},
+			},
+			{
+				svc: second,
+				expected: []string{
+					`s3_access_log_truncated{` + labels + `} 1`,
+					`s3_access_log_objects_total{` + labels + `} 2`,
+					`s3_access_log_requests_total` + requests("REST.PUT.OBJECT", 403) + ` 1`,
+				},
+			},
+			{
+				svc: second,
+				expected: []string{
+					`s3_access_log_truncated{` + labels + `} 0`,
+					`s3_access_log_objects_total{` + labels + `} 3`,
+					`s3_access_log_requests_total` + requests("REST.GET.OBJECT", 200) + ` 3`,
+				},
+			},
+		},
+	}
+	for module, steps := range tests {
+		for i, step := range steps {
+			req, err := http.NewRequest("GET", "/probe?bucket=logs&prefix=logs/&module="+module, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			probeHandler(rr, req, step.svc, conf, nil, 0)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s, probe %d: expected a 200, got %d: %s", module, i, rr.Code, rr.Body.String())
+			}
+
+			for _, l := range step.expected {
+				if !strings.Contains(rr.Body.String(), l) {
+					t.Errorf("%s, probe %d: expected %s in:\n%s", module, i, l, rr.Body.String())
+				}
+			}
+			if strings.Contains(rr.Body.String(), requester(bob)+" 10010") {
+				t.Errorf("%s, probe %d: read a log that was too recent:\n%s", module, i, rr.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/prometheus/common/log"
+)
+
+// ProbeResult is what the JSON API returns for a probe. It has the same
+// figures as the metrics, along with the keys of the newest and oldest
+// objects and the error when the probe failed.
+type ProbeResult struct {
+	Bucket         string `json:"bucket"`
+	Prefix         string `json:"prefix"`
+	ResolvedPrefix string `json:"resolved_prefix"`
+	Delimiter      string `json:"delimiter,omitempty"`
+	Module         string `json:"module"`
+	Success        bool   `json:"success"`
+	Error          string `json:"error,omitempty"`
+	// FailureReason is either "timeout" or "error"
+	FailureReason    string                         `json:"failure_reason,omitempty"`
+	DurationSeconds  float64                        `json:"duration_seconds"`
+	Truncated        bool                           `json:"truncated"`
+	Objects          int64                          `json:"objects"`
+	TotalSizeBytes   int64                          `json:"total_size_bytes"`
+	BiggestSizeBytes int64                          `json:"biggest_size_bytes"`
+	Newest           *ObjectSummary                 `json:"newest,omitempty"`
+	Oldest           *ObjectSummary                 `json:"oldest,omitempty"`
+	CommonPrefixes   *int                           `json:"common_prefixes,omitempty"`
+	StorageClasses   map[string]StorageClassSummary `json:"storage_classes,omitempty"`
+	InventoryCreated *time.Time                     `json:"inventory_created,omitempty"`
+	// FreshnessOK is only set when the probe has expectations
+	FreshnessOK *bool `json:"freshness_ok,omitempty"`
+}
+
+// ObjectSummary describes a single object in a ProbeResult
+type ObjectSummary struct {
+	Key          string    `json:"key"`
+	SizeBytes    int64     `json:"size_bytes"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// StorageClassSummary is the number and size of the objects in a storage
+// class
+type StorageClassSummary struct {
+	Objects   int64 `json:"objects"`
+	SizeBytes int64 `json:"size_bytes"`
+}
+
+// newProbeResult builds the API's view of the outcome of a probe
+func (e *Exporter) newProbeResult(o probeOutcome) *ProbeResult {
+	p := &ProbeResult{
+		Bucket:          e.bucket,
+		Prefix:          e.prefixLabel,
+		ResolvedPrefix:  e.prefix,
+		Delimiter:       e.delimiter,
+		Module:          e.moduleName,
+		Success:         o.err == nil,
+		DurationSeconds: o.duration.Seconds(),
+	}
+	if e.expect.set() && e.delimiter == "" {
+		ok := o.err == nil && e.expect.met(o.result, time.Now())
+		p.FreshnessOK = &ok
+	}
+	if o.err != nil {
+		p.Error = o.err.Error()
+		p.FailureReason = o.reason
+		return p
+	}
+
+	r := o.result
+	p.Truncated = r.truncated
+	p.Objects = r.objects
+	p.TotalSizeBytes = r.totalSize
+	p.BiggestSizeBytes = r.biggestSize
+	if r.objects > 0 {
+		p.Newest = &ObjectSummary{Key: r.lastModifiedKey, SizeBytes: r.lastObjectSize, LastModified: r.lastModified}
+		p.Oldest = &ObjectSummary{Key: r.firstModifiedKey, SizeBytes: r.firstObjectSize, LastModified: r.firstModified}
+	}
+	if e.delimiter != "" {
+		p.CommonPrefixes = &r.commonPrefixes
+	}
+	if e.storageClasses() {
+		for class, t := range r.storageClasses {
+			if p.StorageClasses == nil {
+				p.StorageClasses = map[string]StorageClassSummary{}
+			}
+			p.StorageClasses[class] = StorageClassSummary{Objects: t.objects, SizeBytes: t.totalSize}
+		}
+	}
+	if e.module.Prober == "inventory" {
+		p.InventoryCreated = &r.inventoryCreated
+	}
+	return p
+}
+
+// apiProbeHandler runs a probe like probeHandler does, with the same
+// parameters, but returns the result as JSON
+func apiProbeHandler(w http.ResponseWriter, r *http.Request, svc s3iface.S3API, conf *Config, limiter *probeLimiter, timeoutOffset time.Duration) {
+	runProbe(w, r, svc, conf, limiter, timeoutOffset, func(e *Exporter) {
+		if e.module.Prober != "list" && e.module.Prober != "inventory" {
+			http.Error(w, fmt.Sprintf("the %s prober isn't supported by the API", e.module.Prober), http.StatusBadRequest)
+			return
+		}
+
+		o := e.probe()
+		if o.err != nil {
+			log.Errorln(o.err)
+		}
+		data, err := json.Marshal(e.newProbeResult(o))
+		if err != nil {
+			http.Error(w, "error marshalling json", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestAPIProbeHandler checks the JSON result of probing a prefix
+func TestAPIProbeHandler(t *testing.T) {
+	svc := newMemS3Client(memObjects())
+	conf, err := parseConfig([]byte(`
+modules:
+  head:
+    prober: head
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query string) (*httptest.ResponseRecorder, *ProbeResult) {
+		req, err := http.NewRequest("GET", "/api/v1/probe?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		apiProbeHandler(rr, req, svc, conf, nil, 0)
+		if rr.Code != http.StatusOK {
+			return rr, nil
+		}
+		result := &ProbeResult{}
+		if err := json.Unmarshal(rr.Body.Bytes(), result); err != nil {
+			t.Fatal(err)
+		}
+		return rr, result
+	}
+
+	_, result := get("bucket=mock&prefix=data/&max_age=1h")
+	if !result.Success || result.Objects != 13 || result.TotalSizeBytes != 1378 || result.BiggestSizeBytes != 112 {
+		t.Errorf("unexpected totals: %+v", result)
+	}
+	if result.Newest == nil || result.Newest.Key != "data/9/x/y" || result.Newest.SizeBytes != 104 {
+		t.Errorf("unexpected newest object: %+v", result.Newest)
+	}
+	if result.Oldest == nil || result.Oldest.Key != "data/0a/1" || result.Oldest.SizeBytes != 100 {
+		t.Errorf("unexpected oldest object: %+v", result.Oldest)
+	}
+	if result.FreshnessOK == nil || *result.FreshnessOK {
+		t.Errorf("expected the objects not to be fresh")
+	}
+	if result.CommonPrefixes != nil {
+		t.Errorf("didn't expect common prefixes without a delimiter")
+	}
+
+	_, result = get("bucket=mock&prefix=data/&delimiter=/")
+	if result.CommonPrefixes == nil || *result.CommonPrefixes != 5 {
+		t.Errorf("expected 5 common prefixes, got %+v", result)
+	}
+
+	if rr, _ := get("bucket=mock&module=head&key=data/b"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad request for the head prober, got %d", rr.Code)
+	}
+	if rr, _ := get("prefix=data/"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad request without a bucket, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+)
+
+// Exit codes of the probe command
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitError  = 2
+)
+
+// probeFailures are the metrics that mean a probe failed when they're 0
+var probeFailures = map[string]bool{
+	"s3_list_success":                true,
+	"s3_head_success":                true,
+	"s3_object_exists":               true,
+	"s3_object_content_read_success": true,
+	"s3_object_content_match":        true,
+	"s3_freshness_ok":                true,
+	"s3_object_freshness_ok":         true,
+	"s3_compare_success":             true,
+	"s3_cloudwatch_success":          true,
+	"s3_access_log_success":          true,
+	"s3_cloudtrail_success":          true,
+	"s3_state_success":               true,
+}
+
+// probeMismatches are the metrics that mean a probe failed when they're more
+// than 0
+var probeMismatches = map[string]bool{
+	"s3_compare_missing_objects":       true,
+	"s3_compare_size_mismatch_objects": true,
+	"s3_compare_etag_mismatch_objects": true,
+	"s3_json_extract_failures":         true,
+	"s3_textfile_error":                true,
+	"s3_textfile_stale":                true,
+}
+
+// probeCommand runs a single probe with the same parameters as the probe
+// endpoint and writes the result to w, either as metrics in the text format
+// or as JSON. It returns exitFailed if the probe failed or didn't meet its
+// expectations and exitError if it couldn't be run at all.
+func probeCommand(ctx context.Context, w io.Writer, params url.Values, svc s3iface.S3API, conf *Config, output string) int {
+	e, err := newExporter(params, svc, conf)
+	if err != nil {
+		log.Errorln(err)
+		return exitError
+	}
+	e.ctx = ctx
+
+	switch output {
+	case "json":
+		if e.module.Prober != "list" && e.module.Prober != "inventory" {
+			log.Errorf("the %s prober doesn't support JSON output", e.module.Prober)
+			return exitError
+		}
+		o := e.probe()
+		if o.err != nil {
+			log.Errorln(o.err)
+		}
+		result := e.newProbeResult(o)
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			log.Errorln(err)
+			return exitError
+		}
+		fmt.Fprintln(w, string(data))
+		if !result.Success || (result.FreshnessOK != nil && !*result.FreshnessOK) {
+			return exitFailed
+		}
+		return exitOK
+	case "text":
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(e)
+		mfs, err := registry.Gather()
+		if err != nil {
+			log.Errorln(err)
+			return exitError
+		}
+		code := exitOK
+		for _, mf := range mfs {
+			if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+				log.Errorln(err)
+				return exitError
+			}
+			if probeFailed(mf) {
+				code = exitFailed
+			}
+		}
+		return code
+	default:
+		log.Errorf("unknown output format %q", output)
+		return exitError
+	}
+}
+
+// probeFailed reports whether a metric family says that the probe failed
+func probeFailed(mf *dto.MetricFamily) bool {
+	for _, m := range mf.Metric {
+		if probeFailures[mf.GetName()] && m.GetGauge().GetValue() == 0 {
+			return true
+		}
+		if probeMismatches[mf.GetName()] && m.GetGauge().GetValue() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfigCommand checks the configuration file at path, with the same
+// loader the server uses, and returns exitFailed if it isn't valid
+func checkConfigCommand(w io.Writer, path string) int {
+	if path == "" {
+		fmt.Fprintln(w, "  FAILED: --config.file must be set")
+		return exitError
+	}
+	fmt.Fprintf(w, "Checking %s\n", path)
+	conf, err := loadConfig(path)
+	if err != nil {
+		fmt.Fprintf(w, "  FAILED: %s\n", err)
+		return exitFailed
+	}
+	fmt.Fprintf(w, "  SUCCESS: %d modules found\n", len(conf.Modules))
+	return exitOK
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// TestProbeCommand checks the output and exit code of the probe command
+func TestProbeCommand(t *testing.T) {
+	objects := append(memObjects(),
+		&s3.Object{Key: aws.String("other/job.json"), LastModified: aws.Time(time.Now()), Size: aws.Int64(14)},
+		&s3.Object{Key: aws.String("other/dup.prom"), LastModified: aws.Time(time.Now()), Size: aws.Int64(34)},
+	)
+	svc := newMemS3Client(objects)
+	svc.bodies = map[string][]byte{
+		"other/job.json": []byte(`{"records":12}`),
+		"other/dup.prom": []byte("job_success 1\njob_success 0\n"),
+	}
+	conf, err := parseConfig([]byte(`
+modules:
+  compare:
+    prober: compare
+  head:
+    prober: head
+  json:
+    prober: json
+    json:
+      metrics:
+        - name: job_records
+          path: rows
+  textfile:
+    prober: textfile
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		params   url.Values
+		output   string
+		code     int
+		expected string
+	}{
+		{
+			name:     "text",
+			params:   url.Values{"bucket": {"mock"}, "prefix": {"data/"}},
+			output:   "text",
+			code:     exitOK,
+			expected: `s3_objects{bucket="mock",prefix="data/"} 13`,
+		},
+		{
+			name:     "stale",
+			params:   url.Values{"bucket": {"mock"}, "prefix": {"data/"}, "max_age": {"1h"}},
+			output:   "text",
+			code:     exitFailed,
+			expected: `s3_freshness_ok{bucket="mock",prefix="data/"} 0`,
+		},
+		{
+			name:     "json",
+			params:   url.Values{"bucket": {"mock"}, "prefix": {"data/"}, "min_objects": {"10"}},
+			output:   "json",
+			code:     exitOK,
+			expected: `"freshness_ok": true`,
+		},
+		{
+			name:     "json stale",
+			params:   url.Values{"bucket": {"mock"}, "prefix": {"data/"}, "min_objects": {"20"}},
+			output:   "json",
+			code:     exitFailed,
+			expected: `"freshness_ok": false`,
+		},
+		{
+			name:     "compare",
+			params:   url.Values{"bucket": {"mock"}, "prefix": {"data/0a/"}, "module": {"compare"}, "destination_prefix": {"data/0a/"}},
+			output:   "text",
+			code:     exitOK,
+			expected: `s3_compare_success{bucket="mock",destination_bucket="mock",destination_prefix="data/0a/",prefix="data/0a/"} 1`,
+		},
+		{
+			name:     "compare mismatch",
+			params:   url.Values{"bucket": {"mock"}, "prefix": {"data/0a/"}, "module": {"compare"}, "destination_prefix": {"data/a0/"}},
+			output:   "text",
+			code:     exitFailed,
+			expected: `s3_compare_missing_objects{bucket="mock",destination_bucket="mock",destination_prefix="data/a0/",missing_from="destination",prefix="data/0a/"}`,
+		},
+		{
+			name:     "missing object",
+			params:   url.Values{"bucket": {"mock"}, "key": {"data/missing"}, "module": {"head"}},
+			output:   "text",
+			code:     exitFailed,
+			expected: `s3_object_exists{bucket="mock",key="data/missing"} 0`,
+		},
+		{
+			name:     "json extract failure",
+			params:   url.Values{"bucket": {"mock"}, "key": {"other/job.json"}, "module": {"json"}},
+			output:   "text",
+			code:     exitFailed,
+			expected: `s3_json_extract_failures{bucket="mock",key="other/job.json"} 1`,
+		},
+		{
+			name:     "textfile duplicate series",
+			params:   url.Values{"bucket": {"mock"}, "prefix": {"other/"}, "module": {"textfile"}},
+			output:   "text",
+			code:     exitFailed,
+			expected: `s3_textfile_error{bucket="mock",key="other/dup.prom"} 1`,
+		},
+		{
+			name:   "unknown module",
+			params: url.Values{"bucket": {"mock"}, "module": {"nope"}},
+			output: "text",
+			code:   exitError,
+		},
+	}
+	for _, tc := range tests {
+		var out bytes.Buffer
+		code := probeCommand(context.Background(), &out, tc.params, svc, conf, tc.output)
+		if code != tc.code {
+			t.Errorf("%s: expected exit code %d, got %d", tc.name, tc.code, code)
+		}
+		if !strings.Contains(out.String(), tc.expected) {
+			t.Errorf("%s: expected %s in:\n%s", tc.name, tc.expected, out.String())
+		}
+		if tc.output == "json" {
+			if err := json.Unmarshal(out.Bytes(), &ProbeResult{}); err != nil {
+				t.Errorf("%s: expected valid JSON, got %s", tc.name, err)
+			}
+		}
+	}
+}
+
+// TestCheckConfigCommand checks that check-config passes good files and
+// fails bad ones with the line of the error
+func TestCheckConfigCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		config   string
+		code     int
+		expected string
+	}{
+		{
+			config: `
+modules:
+  other_account:
+    s3:
+      region: eu-west-1
+      role_arn: arn:aws:iam::123456789012:role/s3-exporter
+  minio:
+    s3:
+      endpoint_url: http://minio:9000
+      force_path_style: true
+`,
+			code:     exitOK,
+			expected: "SUCCESS: 3 modules found",
+		},
+		{
+			config: `
+modules:
+  foo:
+    prefix_offset: 1d
+    max_age: soon
+`,
+			code:     exitFailed,
+			expected: `FAILED: line 5: not a valid duration string: "soon"`,
+		},
+	}
+	for i, tc := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("%d.yml", i))
+		if err := ioutil.WriteFile(path, []byte(tc.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if code := checkConfigCommand(&out, path); code != tc.code {
+			t.Errorf("%d: expected exit code %d, got %d", i, tc.code, code)
+		}
+		if !strings.Contains(out.String(), tc.expected) {
+			t.Errorf("%d: expected %s, got %s", i, tc.expected, out.String())
+		}
+	}
+}
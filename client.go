@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// S3Config is how to connect to S3. The flags set it for every probe and
+// modules can override it.
+type S3Config struct {
+	// EndpointURL is used instead of the AWS endpoint, for S3 compatible
+	// storage
+	EndpointURL string `yaml:"endpoint_url,omitempty"`
+	Region      string `yaml:"region,omitempty"`
+	// RoleARN is an IAM role to assume, for buckets in other accounts
+	RoleARN        string `yaml:"role_arn,omitempty"`
+	ForcePathStyle bool   `yaml:"force_path_style,omitempty"`
+	DisableSSL     bool   `yaml:"disable_ssl,omitempty"`
+}
+
+// UnmarshalYAML validates an S3 config
+func (c *S3Config) UnmarshalYAML(value *yaml.Node) error {
+	type plain S3Config
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	if err := c.validate(); err != nil {
+		return fmt.Errorf("line %d: %s", value.Line, err)
+	}
+	return nil
+}
+
+// validate checks the endpoint URL and role ARN
+func (c *S3Config) validate() error {
+	if c.EndpointURL != "" {
+		u, err := url.Parse(c.EndpointURL)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint_url: %s", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid endpoint_url %q, it must be an http or https URL", c.EndpointURL)
+		}
+	}
+	if c.RoleARN != "" {
+		a, err := arn.Parse(c.RoleARN)
+		if err != nil {
+			return fmt.Errorf("invalid role_arn: %s", err)
+		}
+		if a.Service != "iam" || !strings.HasPrefix(a.Resource, "role/") {
+			return fmt.Errorf("invalid role_arn %q, it must be the ARN of an IAM role", c.RoleARN)
+		}
+	}
+	return nil
+}
+
+// override returns c with anything that's set in o taking its place
+func (c S3Config) override(o *S3Config) S3Config {
+	if o == nil {
+		return c
+	}
+	if o.EndpointURL != "" {
+		c.EndpointURL = o.EndpointURL
+	}
+	if o.Region != "" {
+		c.Region = o.Region
+	}
+	if o.RoleARN != "" {
+		c.RoleARN = o.RoleARN
+	}
+	c.ForcePathStyle = c.ForcePathStyle || o.ForcePathStyle
+	c.DisableSSL = c.DisableSSL || o.DisableSSL
+	return c
+}
+
+// newS3Client creates an instrumented client for the S3 API. Every client
+// shares limiter, if there is one.
+func newS3Client(sess *session.Session, c S3Config, limiter *rate.Limiter) *s3.S3 {
+	cfg := aws.NewConfig()
+	if c.EndpointURL != "" {
+		cfg.WithEndpoint(c.EndpointURL)
+	}
+	if c.Region != "" {
+		cfg.WithRegion(c.Region)
+	}
+	if c.RoleARN != "" {
+		cfg.WithCredentials(stscreds.NewCredentials(sess, c.RoleARN))
+	}
+	cfg.WithDisableSSL(c.DisableSSL)
+	cfg.WithS3ForcePathStyle(c.ForcePathStyle)
+
+	svc := s3.New(sess, cfg)
+	instrumentHandlers(&svc.Handlers)
+	if limiter != nil {
+		svc.Handlers.Sign.PushFrontNamed(rateLimitHandler(limiter))
+	}
+	return svc
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	s3CloudTrailSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cloudtrail", "success"),
+		"If the new CloudTrail log files were read",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3CloudTrailTruncated = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cloudtrail", "truncated"),
+		"If the probe stopped early because it ran out of budget, leaving log files for the next probe",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3CloudTrailObjects = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cloudtrail", "objects_total"),
+		"The number of CloudTrail log files read",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3CloudTrailInvalidObjects = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cloudtrail", "invalid_objects_total"),
+		"The number of CloudTrail log files that couldn't be decoded and were skipped",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3CloudTrailEvents = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cloudtrail", "events_total"),
+		"The number of S3 data events for the bucket they were made to, by event name and the ARN of the principal that made them",
+		[]string{"bucket", "prefix", "source_bucket", "event_name", "principal"}, nil,
+	)
+	s3CloudTrailLastWrite = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cloudtrail", "last_write_date"),
+		"The time of the latest S3 data event for the bucket they were made to",
+		[]string{"bucket", "prefix", "source_bucket"}, nil,
+	)
+)
+
+// otherPrincipals is the principal label of events from principals over
+// max_principals
+const otherPrincipals = "other"
+
+// cloudTrailDayLayout is the layout of the directories CloudTrail delivers a
+// day's log files to
+const cloudTrailDayLayout = "2006/01/02/"
+
+// cloudTrailFileTime finds the time in the name of a CloudTrail log file,
+// like 123456789012_CloudTrail_eu-west-1_20261018T1305Z_abcdef.json.gz
+var cloudTrailFileTime = regexp.MustCompile(`_(\d{8}T\d{4}Z)_[^/]*$`)
+
+// CloudTrailConfig configures the cloudtrail prober, which counts the S3 data
+// events in CloudTrail log files. The bucket and prefix parameters are where
+// the log files are delivered to, up to and including the region, like
+// AWSLogs/123456789012/CloudTrail/eu-west-1/.
+type CloudTrailConfig struct {
+	// Buckets are the buckets whose events are counted
+	Buckets []string `yaml:"buckets"`
+	// EventNames are the events that are counted
+	EventNames []string `yaml:"event_names,omitempty"`
+	// Lookback is how far back the first probe starts reading from
+	Lookback model.Duration `yaml:"lookback,omitempty"`
+	// Delay is how old log files must be before they're read. Log files that
+	// are delivered after this long are never counted.
+	Delay model.Duration `yaml:"delay,omitempty"`
+	// MaxPrincipals is how many principals get their own label. Events from
+	// any more are counted together.
+	MaxPrincipals int `yaml:"max_principals,omitempty"`
+}
+
+// UnmarshalYAML sets the defaults for a CloudTrail config and validates it
+func (c *CloudTrailConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain CloudTrailConfig
+	*c = CloudTrailConfig{
+		EventNames:    []string{"PutObject", "DeleteObject", "CopyObject"},
+		Lookback:      model.Duration(time.Hour),
+		Delay:         model.Duration(15 * time.Minute),
+		MaxPrincipals: 100,
+	}
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	if len(c.Buckets) == 0 {
+		return fmt.Errorf("line %d: cloudtrail buckets must be set", value.Line)
+	}
+	if len(c.EventNames) == 0 {
+		return fmt.Errorf("line %d: cloudtrail event_names can't be empty", value.Line)
+	}
+	if c.Lookback <= 0 {
+		return fmt.Errorf("line %d: lookback must be more than 0", value.Line)
+	}
+	if c.Delay < 0 {
+		return fmt.Errorf("line %d: delay can't be negative", value.Line)
+	}
+	if c.MaxPrincipals < 0 {
+		return fmt.Errorf("line %d: max_principals can't be negative", value.Line)
+	}
+	return nil
+}
+
+// cloudTrailRecord is the part of a CloudTrail event that's counted
+type cloudTrailRecord struct {
+	EventTime    time.Time `json:"eventTime"`
+	EventSource  string    `json:"eventSource"`
+	EventName    string    `json:"eventName"`
+	UserIdentity struct {
+		Type string `json:"type"`
+		ARN  string `json:"arn"`
+	} `json:"userIdentity"`
+	RequestParameters struct {
+		BucketName string `json:"bucketName"`
+	} `json:"requestParameters"`
+}
+
+// principal is who made the request, which is the type of identity for
+// those without an ARN, like AWS services
+func (r *cloudTrailRecord) principal() string {
+	if r.UserIdentity.ARN != "" {
+		return r.UserIdentity.ARN
+	}
+	if r.UserIdentity.Type != "" {
+		return r.UserIdentity.Type
+	}
+	return "unknown"
+}
+
+// cloudTrailCount is the events for a combination of labels
+type cloudTrailCount struct {
+	SourceBucket string  `json:"source_bucket"`
+	EventName    string  `json:"event_name"`
+	Principal    string  `json:"principal"`
+	Events       float64 `json:"events"`
+}
+
+// cloudTrailState is the totals of every log file read so far
+type cloudTrailState struct {
+	// LastKey is the key that the next probe reads after
+	LastKey        string            `json:"last_key"`
+	Objects        float64           `json:"objects"`
+	InvalidObjects float64           `json:"invalid_objects"`
+	Events         []cloudTrailCount `json:"events"`
+	// LastWrites is the time of the latest event for each bucket
+	LastWrites map[string]time.Time `json:"last_writes,omitempty"`
+}
+
+// cloudTrailTotals are the counts in a cloudTrailState, keyed by their labels
+type cloudTrailTotals struct {
+	events     map[cloudTrailCount]float64
+	principals map[string]bool
+}
+
+func newCloudTrailTotals(s *cloudTrailState) *cloudTrailTotals {
+	t := &cloudTrailTotals{
+		events:     map[cloudTrailCount]float64{},
+		principals: map[string]bool{},
+	}
+	for _, c := range s.Events {
+		t.events[cloudTrailCount{SourceBucket: c.SourceBucket, EventName: c.EventName, Principal: c.Principal}] = c.Events
+		if c.Principal != otherPrincipals {
+			t.principals[c.Principal] = true
+		}
+	}
+	return t
+}
+
+// add counts an event
+func (t *cloudTrailTotals) add(r *cloudTrailRecord, maxPrincipals int) {
+	principal := r.principal()
+	if !t.principals[principal] {
+		if len(t.principals) >= maxPrincipals {
+			principal = otherPrincipals
+		} else {
+			t.principals[principal] = true
+		}
+	}
+	t.events[cloudTrailCount{SourceBucket: r.RequestParameters.BucketName, EventName: r.EventName, Principal: principal}]++
+}
+
+// sorted returns the counts sorted by their labels, so that the state is
+// saved the same way each time
+func (t *cloudTrailTotals) sorted() []cloudTrailCount {
+	var all []cloudTrailCount
+	for c, n := range t.events {
+		c.Events = n
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if a.SourceBucket != b.SourceBucket {
+			return a.SourceBucket < b.SourceBucket
+		}
+		if a.EventName != b.EventName {
+			return a.EventName < b.EventName
+		}
+		return a.Principal < b.Principal
+	})
+	return all
+}
+
+// cloudTrailFileDate is when a log file is for, from its name if it can be
+// found there or else when it was delivered
+func cloudTrailFileDate(o *objectInfo) time.Time {
+	if m := cloudTrailFileTime.FindStringSubmatch(o.Key); m != nil {
+		if t, err := time.Parse("20060102T1504Z", m[1]); err == nil {
+			return t
+		}
+	}
+	return o.LastModified
+}
+
+// decodeCloudTrail reads the records in a log file, which is gzipped JSON.
+// Files that have already been decompressed on the way, by a proxy or a
+// client that asked for it, are read as they are.
+func decodeCloudTrail(body io.Reader) ([]cloudTrailRecord, error) {
+	br := bufio.NewReader(body)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	var file struct {
+		Records []cloudTrailRecord `json:"Records"`
+	}
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, err
+	}
+	return file.Records, nil
+}
+
+// readCloudTrail reads a log file and adds the events for the buckets to the
+// totals. A file that can't be decoded is counted and skipped rather than
+// failing every probe from then on.
+func (e *Exporter) readCloudTrail(key string, s *cloudTrailState, t *cloudTrailTotals) error {
+	conf := e.module.CloudTrail
+	body, err := e.lister.Get(e.ctx, e.bucket, key, "")
+	if err != nil {
+		return fmt.Errorf("error getting CloudTrail log file %s: %s", key, err)
+	}
+	defer body.Close()
+
+	records, err := decodeCloudTrail(body)
+	if err != nil {
+		if e.ctx.Err() != nil {
+			return e.ctx.Err()
+		}
+		log.Warnf("Skipping CloudTrail log file %s: %s", key, err)
+		s.InvalidObjects++
+		return nil
+	}
+	for i := range records {
+		r := &records[i]
+		if r.EventSource != "s3.amazonaws.com" ||
+			!containsString(conf.Buckets, r.RequestParameters.BucketName) ||
+			!containsString(conf.EventNames, r.EventName) {
+			continue
+		}
+		t.add(r, conf.MaxPrincipals)
+		if bucket := r.RequestParameters.BucketName; r.EventTime.After(s.LastWrites[bucket]) {
+			if s.LastWrites == nil {
+				s.LastWrites = map[string]time.Time{}
+			}
+			s.LastWrites[bucket] = r.EventTime
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// cloudTrail reads the log files delivered since the last one read by the
+// probe before and adds their events to the totals so far
+func (e *Exporter) cloudTrail() (*cloudTrailState, bool, error) {
+	conf := e.module.CloudTrail
+	store := e.totalsStore()
+	id := e.stateID() + "-cloudtrail"
+	defer lockState(id)()
+
+	s := &cloudTrailState{}
+	data, err := store.load(e.ctx, id)
+	if err != nil {
+		return nil, false, fmt.Errorf("error loading CloudTrail state: %s", err)
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, false, fmt.Errorf("error decoding CloudTrail state: %s", err)
+		}
+	}
+	totals := newCloudTrailTotals(s)
+
+	// The first probe starts from the directory of the day the lookback
+	// starts on, and skips the files in it from before then
+	now := time.Now()
+	startAfter := s.LastKey
+	var since time.Time
+	if !strings.HasPrefix(startAfter, e.prefix) {
+		since = now.Add(-time.Duration(conf.Lookback))
+		startAfter = e.prefix + since.UTC().Format(cloudTrailDayLayout)
+	}
+	until := now.Add(-time.Duration(conf.Delay))
+
+	stop := func(o *objectInfo) bool { return cloudTrailFileDate(o).After(until) }
+	truncated, err := e.tailObjects(startAfter, stop, func(o *objectInfo) error {
+		if strings.HasSuffix(o.Key, ".json.gz") && !cloudTrailFileDate(o).Before(since) {
+			if err := e.readCloudTrail(o.Key, s, totals); err != nil {
+				return err
+			}
+			s.Objects++
+		}
+		s.LastKey = o.Key
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.Events = totals.sorted()
+	data, err = json.Marshal(s)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := store.save(e.ctx, id, data); err != nil {
+		return nil, false, fmt.Errorf("error saving CloudTrail state: %s", err)
+	}
+	return s, truncated, nil
+}
+
+func (e *Exporter) describeCloudTrail(ch chan<- *prometheus.Desc) {
+	ch <- s3CloudTrailSuccess
+	ch <- s3CloudTrailTruncated
+	ch <- s3CloudTrailObjects
+	ch <- s3CloudTrailInvalidObjects
+	ch <- s3CloudTrailEvents
+	ch <- s3CloudTrailLastWrite
+	if e.prefix != e.prefixLabel {
+		ch <- s3ResolvedPrefix
+	}
+}
+
+// collectCloudTrail reads the new log files and reports the totals
+func (e *Exporter) collectCloudTrail(ch chan<- prometheus.Metric) {
+	if e.prefix != e.prefixLabel {
+		ch <- prometheus.MustNewConstMetric(
+			s3ResolvedPrefix, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel, e.prefix,
+		)
+	}
+
+	start := time.Now()
+	s, truncated, err := e.cloudTrail()
+	observeProbe(e.moduleName, start, err == nil)
+	if err != nil {
+		log.Errorln(err)
+		ch <- prometheus.MustNewConstMetric(
+			s3CloudTrailSuccess, prometheus.GaugeValue, 0, e.bucket, e.prefixLabel,
+		)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		s3CloudTrailSuccess, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3CloudTrailTruncated, prometheus.GaugeValue, boolToFloat(truncated), e.bucket, e.prefixLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3CloudTrailObjects, prometheus.CounterValue, s.Objects, e.bucket, e.prefixLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3CloudTrailInvalidObjects, prometheus.CounterValue, s.InvalidObjects, e.bucket, e.prefixLabel,
+	)
+	for _, c := range s.Events {
+		ch <- prometheus.MustNewConstMetric(
+			s3CloudTrailEvents, prometheus.CounterValue, c.Events, e.bucket, e.prefixLabel, c.SourceBucket, c.EventName, c.Principal,
+		)
+	}
+	for bucket, t := range s.LastWrites {
+		ch <- prometheus.MustNewConstMetric(
+			s3CloudTrailLastWrite, prometheus.GaugeValue, float64(t.Unix()), e.bucket, e.prefixLabel, bucket,
+		)
+	}
+}
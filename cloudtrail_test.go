@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// newCloudTrailBucket serves the log files in testdata/cloudtrail gzipped,
+// the way CloudTrail delivers them, apart from the one from 2 October which
+// is served as it is
+func newCloudTrailBucket(t *testing.T) *memS3Client {
+	svc := newMemS3ClientFromDir(t, "testdata/cloudtrail")
+	bodies := map[string][]byte{}
+	for _, o := range svc.objects {
+		key := aws.StringValue(o.Key)
+		body := svc.bodies[key]
+		if !strings.Contains(key, "20261002T") {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(body)
+			if err := gz.Close(); err != nil {
+				t.Fatal(err)
+			}
+			body = buf.Bytes()
+		}
+		o.Key = aws.String(key + ".gz")
+		o.Size = aws.Int64(int64(len(body)))
+		bodies[key+".gz"] = body
+	}
+	svc.bodies = bodies
+	return svc
+}
+
+// TestProbeHandlerCloudTrail checks that each log file is counted once,
+// across probes and after running out of budget. What a probe reports is in
+// the cloudtrail golden tests.
+func TestProbeHandlerCloudTrail(t *testing.T) {
+	memoryState = newMemStateStore(defaultMemoryStateTargets)
+
+	conf, err := parseConfig([]byte(`
+modules:
+  trail:
+    prober: cloudtrail
+    cloudtrail:
+      buckets: [data, logs]
+      lookback: 100y
+  budget:
+    prober: cloudtrail
+    max_objects: 2
+    cloudtrail:
+      buckets: [data, logs]
+      lookback: 100y
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := newCloudTrailBucket(t)
+
+	prefix := "AWSLogs/123456789012/CloudTrail/eu-west-1/"
+	labels := `bucket="trail",prefix="` + prefix + `"`
+	events := func(bucket, event, principal string) string {
+		return `s3_cloudtrail_events_total{bucket="trail",event_name="` + event + `",prefix="` + prefix + `",principal="` + principal + `",source_bucket="` + bucket + `"}`
+	}
+	lastWrite := func(bucket string, t time.Time) string {
+		return `s3_cloudtrail_last_write_date{` + labels + `,source_bucket="` + bucket + `"} ` + fmt.Sprintf("%g", float64(t.Unix()))
+	}
+	alice := "arn:aws:iam::123456789012:user/alice"
+	bob := "arn:aws:iam::123456789012:user/bob"
+	tests := map[string][][]string{
+		"trail": {
+			// The first probe reads every file
+			{},
+			// Nothing new, so nothing is counted again
+			{
+				`s3_cloudtrail_objects_total{` + labels + `} 4`,
+				events("data", "PutObject", alice) + ` 3`,
+			},
+		},
+		"budget": {
+			{
+				`s3_cloudtrail_truncated{` + labels + `} 1`,
+				`s3_cloudtrail_objects_total{` + labels + `} 2`,
+				events("data", "PutObject", alice) + ` 2`,
+				lastWrite("data", time.Date(2026, time.October, 1, 0, 7, 0, 0, time.UTC)),
+			},
+			{
+				`s3_cloudtrail_truncated{` + labels + `} 0`,
+				`s3_cloudtrail_objects_total{` + labels + `} 4`,
+				`s3_cloudtrail_invalid_objects_total{` + labels + `} 1`,
+				events("data", "PutObject", alice) + ` 3`,
+				events("data", "DeleteObject", bob) + ` 1`,
+			},
+		},
+	}
+	for module, steps := range tests {
+		for i, expected := range steps {
+			req, err := http.NewRequest("GET", "/probe?bucket=trail&prefix="+prefix+"&module="+module, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			probeHandler(rr, req, svc, conf, nil, 0)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s, probe %d: expected a 200, got %d: %s", module, i, rr.Code, rr.Body.String())
+			}
+
+			for _, l := range expected {
+				if !strings.Contains(rr.Body.String(), l) {
+					t.Errorf("%s, probe %d: expected %s in:\n%s", module, i, l, rr.Body.String())
+				}
+			}
+		}
+	}
+}
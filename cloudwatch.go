@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// cloudWatchSource is the source label of the metrics read from CloudWatch,
+// which tells them apart from the same metrics worked out by listing
+const cloudWatchSource = "cloudwatch"
+
+// allStorageTypes is the storage type S3 reports NumberOfObjects under
+const allStorageTypes = "AllStorageTypes"
+
+// defaultCloudWatchLookback allows for S3 sending the storage metrics a day
+// or two late
+const defaultCloudWatchLookback = model.Duration(72 * time.Hour)
+
+var (
+	s3CloudWatchSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cloudwatch", "success"),
+		"If the bucket's storage metrics were read from CloudWatch",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3CloudWatchDate = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cloudwatch", "datapoint_date"),
+		"When the newest of the datapoints read from CloudWatch was for. S3 only sends the storage metrics once a day.",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3CloudWatchObjects = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "objects"),
+		"The total number of objects for the bucket/prefix combination",
+		[]string{"bucket", "prefix", "source", "storage_type"}, nil,
+	)
+	s3CloudWatchSize = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "objects_size_sum_bytes"),
+		"The total size of all objects summed",
+		[]string{"bucket", "prefix", "source", "storage_type"}, nil,
+	)
+)
+
+// CloudWatchConfig configures the cloudwatch prober, which reads the
+// BucketSizeBytes and NumberOfObjects metrics S3 sends to CloudWatch every
+// day instead of listing the bucket. They only cover whole buckets.
+type CloudWatchConfig struct {
+	// EndpointURL is used instead of the AWS endpoint for CloudWatch
+	EndpointURL string `yaml:"endpoint_url,omitempty"`
+	// Region has to be the bucket's region, as that's where S3 sends its
+	// metrics
+	Region string `yaml:"region,omitempty"`
+	// RoleARN is an IAM role to assume, for buckets in other accounts
+	RoleARN string `yaml:"role_arn,omitempty"`
+	// StorageTypes are the storage types to read BucketSizeBytes for, like
+	// StandardStorage. By default they're found with ListMetrics.
+	StorageTypes []string `yaml:"storage_types,omitempty"`
+	// Lookback is how far back to look for the latest datapoints
+	Lookback model.Duration `yaml:"lookback,omitempty"`
+}
+
+// UnmarshalYAML sets the defaults for a cloudwatch config and validates it
+func (c *CloudWatchConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain CloudWatchConfig
+	*c = CloudWatchConfig{Lookback: defaultCloudWatchLookback}
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	s3 := S3Config{EndpointURL: c.EndpointURL, RoleARN: c.RoleARN}
+	if err := s3.validate(); err != nil {
+		return fmt.Errorf("line %d: %s", value.Line, err)
+	}
+	if c.Lookback < model.Duration(24*time.Hour) {
+		return fmt.Errorf("line %d: lookback must be at least 1d, as there's only a datapoint a day", value.Line)
+	}
+	return nil
+}
+
+// newCloudWatchClient creates an instrumented client for the CloudWatch API
+func newCloudWatchClient(sess *session.Session, c *CloudWatchConfig) *cloudwatch.CloudWatch {
+	cfg := aws.NewConfig()
+	if c.EndpointURL != "" {
+		cfg.WithEndpoint(c.EndpointURL)
+	}
+	if c.Region != "" {
+		cfg.WithRegion(c.Region)
+	}
+	if c.RoleARN != "" {
+		cfg.WithCredentials(stscreds.NewCredentials(sess, c.RoleARN))
+	}
+
+	svc := cloudwatch.New(sess, cfg)
+	instrumentHandlers(&svc.Handlers)
+	return svc
+}
+
+// cloudWatchResult is the latest value of each metric, by storage type
+type cloudWatchResult struct {
+	objects map[string]float64
+	sizes   map[string]float64
+	// latest is when the newest datapoint was for
+	latest time.Time
+}
+
+// bucketMetricQuery asks for the daily values of one of the bucket's storage
+// metrics
+func (e *Exporter) bucketMetricQuery(id, metric, storageType string) *cloudwatch.MetricDataQuery {
+	return &cloudwatch.MetricDataQuery{
+		Id: aws.String(id),
+		MetricStat: &cloudwatch.MetricStat{
+			Metric: &cloudwatch.Metric{
+				Namespace:  aws.String("AWS/S3"),
+				MetricName: aws.String(metric),
+				Dimensions: []*cloudwatch.Dimension{
+					{Name: aws.String("BucketName"), Value: aws.String(e.bucket)},
+					{Name: aws.String("StorageType"), Value: aws.String(storageType)},
+				},
+			},
+			Period: aws.Int64(86400),
+			Stat:   aws.String("Average"),
+		},
+	}
+}
+
+// storageTypes finds the storage types S3 has sent BucketSizeBytes for
+func (e *Exporter) storageTypes(svc cloudwatchiface.CloudWatchAPI) ([]string, error) {
+	var types []string
+	input := &cloudwatch.ListMetricsInput{
+		Namespace:  aws.String("AWS/S3"),
+		MetricName: aws.String("BucketSizeBytes"),
+		Dimensions: []*cloudwatch.DimensionFilter{
+			{Name: aws.String("BucketName"), Value: aws.String(e.bucket)},
+		},
+	}
+	err := svc.ListMetricsPagesWithContext(e.ctx, input, func(page *cloudwatch.ListMetricsOutput, lastPage bool) bool {
+		for _, m := range page.Metrics {
+			for _, d := range m.Dimensions {
+				if aws.StringValue(d.Name) == "StorageType" {
+					types = append(types, aws.StringValue(d.Value))
+				}
+			}
+		}
+		return true
+	})
+	sort.Strings(types)
+	return types, err
+}
+
+// readCloudWatch reads the latest value of the bucket's storage metrics
+func (e *Exporter) readCloudWatch() (*cloudWatchResult, error) {
+	svc := e.module.cloudwatch
+	if svc == nil {
+		return nil, fmt.Errorf("module %s has no CloudWatch client", e.moduleName)
+	}
+	conf := e.module.CloudWatch
+	types := conf.StorageTypes
+	if len(types) == 0 {
+		var err error
+		types, err = e.storageTypes(svc)
+		if err != nil {
+			return nil, fmt.Errorf("error listing storage types: %s", err)
+		}
+	}
+
+	queries := []*cloudwatch.MetricDataQuery{
+		e.bucketMetricQuery("objects", "NumberOfObjects", allStorageTypes),
+	}
+	sizes := map[string]string{}
+	for i, t := range types {
+		id := fmt.Sprintf("size%d", i)
+		sizes[id] = t
+		queries = append(queries, e.bucketMetricQuery(id, "BucketSizeBytes", t))
+	}
+
+	end := time.Now()
+	input := &cloudwatch.GetMetricDataInput{
+		MetricDataQueries: queries,
+		StartTime:         aws.Time(end.Add(-time.Duration(conf.Lookback))),
+		EndTime:           aws.Time(end),
+		ScanBy:            aws.String(cloudwatch.ScanByTimestampDescending),
+	}
+	r := &cloudWatchResult{objects: map[string]float64{}, sizes: map[string]float64{}}
+	// Each metric's latest value, which may not be in the first page the
+	// metric turns up in
+	latest := map[string]time.Time{}
+	err := svc.GetMetricDataPagesWithContext(e.ctx, input, func(page *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+		for _, result := range page.MetricDataResults {
+			id := aws.StringValue(result.Id)
+			for i, ts := range result.Timestamps {
+				if i >= len(result.Values) || !aws.TimeValue(ts).After(latest[id]) {
+					continue
+				}
+				latest[id] = aws.TimeValue(ts)
+				if id == "objects" {
+					r.objects[allStorageTypes] = aws.Float64Value(result.Values[i])
+				} else if t, ok := sizes[id]; ok {
+					r.sizes[t] = aws.Float64Value(result.Values[i])
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting metric data: %s", err)
+	}
+	for _, t := range latest {
+		if t.After(r.latest) {
+			r.latest = t
+		}
+	}
+	return r, nil
+}
+
+func (e *Exporter) describeCloudWatch(ch chan<- *prometheus.Desc) {
+	ch <- s3CloudWatchSuccess
+	ch <- s3CloudWatchDate
+	ch <- s3CloudWatchObjects
+	ch <- s3CloudWatchSize
+}
+
+// collectCloudWatch reports the bucket's storage metrics from CloudWatch.
+// Storage types without a datapoint in the lookback aren't reported.
+func (e *Exporter) collectCloudWatch(ch chan<- prometheus.Metric) {
+	start := time.Now()
+	r, err := e.readCloudWatch()
+	observeProbe(e.moduleName, start, err == nil)
+	if err != nil {
+		log.Errorln(err)
+		ch <- prometheus.MustNewConstMetric(
+			s3CloudWatchSuccess, prometheus.GaugeValue, 0, e.bucket, e.prefixLabel,
+		)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		s3CloudWatchSuccess, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel,
+	)
+	if !r.latest.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			s3CloudWatchDate, prometheus.GaugeValue, float64(r.latest.Unix()), e.bucket, e.prefixLabel,
+		)
+	}
+	for t, v := range r.objects {
+		ch <- prometheus.MustNewConstMetric(
+			s3CloudWatchObjects, prometheus.GaugeValue, v, e.bucket, e.prefixLabel, cloudWatchSource, t,
+		)
+	}
+	for t, v := range r.sizes {
+		ch <- prometheus.MustNewConstMetric(
+			s3CloudWatchSize, prometheus.GaugeValue, v, e.bucket, e.prefixLabel, cloudWatchSource, t,
+		)
+	}
+}
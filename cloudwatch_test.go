@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cloudWatchDatapoint is a value in fakeCloudWatch
+type cloudWatchDatapoint struct {
+	time  time.Time
+	value float64
+}
+
+// fakeCloudWatch answers ListMetrics and GetMetricData for the storage
+// metrics of buckets. Datapoints are keyed by bucket, metric name and
+// storage type, joined with slashes.
+type fakeCloudWatch struct {
+	*httptest.Server
+	datapoints map[string][]cloudWatchDatapoint
+}
+
+func newFakeCloudWatch(datapoints map[string][]cloudWatchDatapoint) *fakeCloudWatch {
+	f := &fakeCloudWatch{datapoints: datapoints}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeCloudWatch) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Form.Get("Action") {
+	case "ListMetrics":
+		f.listMetrics(w, r)
+	case "GetMetricData":
+		f.getMetricData(w, r)
+	default:
+		f.error(w, "InvalidAction")
+	}
+}
+
+func (f *fakeCloudWatch) error(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>1</RequestId></ErrorResponse>`, code, code)
+}
+
+type fakeCloudWatchDimension struct {
+	Name  string `xml:"Name"`
+	Value string `xml:"Value"`
+}
+
+// listMetrics lists a metric for each storage type of the bucket
+func (f *fakeCloudWatch) listMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Form.Get("Dimensions.member.1.Name") != "BucketName" {
+		f.error(w, "InvalidParameterCombination")
+		return
+	}
+	bucket := r.Form.Get("Dimensions.member.1.Value")
+	metric := r.Form.Get("MetricName")
+
+	type cwMetric struct {
+		Namespace  string                    `xml:"Namespace"`
+		MetricName string                    `xml:"MetricName"`
+		Dimensions []fakeCloudWatchDimension `xml:"Dimensions>member"`
+	}
+	result := struct {
+		XMLName xml.Name   `xml:"ListMetricsResponse"`
+		Metrics []cwMetric `xml:"ListMetricsResult>Metrics>member"`
+	}{}
+	for key := range f.datapoints {
+		parts := strings.Split(key, "/")
+		if parts[0] != bucket || parts[1] != metric {
+			continue
+		}
+		result.Metrics = append(result.Metrics, cwMetric{
+			Namespace:  "AWS/S3",
+			MetricName: metric,
+			Dimensions: []fakeCloudWatchDimension{
+				{Name: "StorageType", Value: parts[2]},
+				{Name: "BucketName", Value: bucket},
+			},
+		})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// getMetricData returns all the datapoints for each query, ignoring the
+// time range
+func (f *fakeCloudWatch) getMetricData(w http.ResponseWriter, r *http.Request) {
+	type cwResult struct {
+		ID         string   `xml:"Id"`
+		StatusCode string   `xml:"StatusCode"`
+		Timestamps []string `xml:"Timestamps>member"`
+		Values     []string `xml:"Values>member"`
+	}
+	result := struct {
+		XMLName xml.Name   `xml:"GetMetricDataResponse"`
+		Results []cwResult `xml:"GetMetricDataResult>MetricDataResults>member"`
+	}{}
+	for i := 1; ; i++ {
+		query := fmt.Sprintf("MetricDataQueries.member.%d.", i)
+		id := r.Form.Get(query + "Id")
+		if id == "" {
+			break
+		}
+		metric := query + "MetricStat.Metric."
+		dimensions := map[string]string{}
+		for j := 1; ; j++ {
+			dimension := fmt.Sprintf("%sDimensions.member.%d.", metric, j)
+			name := r.Form.Get(dimension + "Name")
+			if name == "" {
+				break
+			}
+			dimensions[name] = r.Form.Get(dimension + "Value")
+		}
+		if bucket := dimensions["BucketName"]; bucket == "broken" {
+			f.error(w, "InternalServiceError")
+			return
+		}
+
+		key := dimensions["BucketName"] + "/" + r.Form.Get(metric+"MetricName") + "/" + dimensions["StorageType"]
+		res := cwResult{ID: id, StatusCode: "Complete"}
+		for _, d := range f.datapoints[key] {
+			res.Timestamps = append(res.Timestamps, d.time.UTC().Format(time.RFC3339))
+			res.Values = append(res.Values, fmt.Sprint(d.value))
+		}
+		result.Results = append(result.Results, res)
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// TestProbeHandlerCloudWatch checks that probes of part of a bucket are
+// rejected. What the probes report is in the cloudwatch golden tests.
+func TestProbeHandlerCloudWatch(t *testing.T) {
+	conf, err := parseConfig([]byte(`
+modules:
+  cloudwatch:
+    prober: cloudwatch
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{
+		"bucket=mock&module=cloudwatch&prefix=a/",
+		"bucket=mock&module=cloudwatch&delimiter=/",
+	} {
+		req, err := http.NewRequest("GET", "/probe?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, newMemS3Client(nil), conf, nil, 0)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected a 400, got %d: %s", query, rr.Code, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var compareLabels = []string{"bucket", "prefix", "destination_bucket", "destination_prefix"}
+
+var (
+	s3CompareSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "compare", "success"),
+		"If both sides of the comparison were listed",
+		compareLabels, nil,
+	)
+	s3CompareDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "compare", "duration_seconds"),
+		"The duration of the comparison",
+		compareLabels, nil,
+	)
+	s3CompareTruncated = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "compare", "truncated"),
+		"If the comparison stopped early because it ran out of budget on either side",
+		compareLabels, nil,
+	)
+	s3CompareObjects = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "compare", "objects"),
+		"The number of objects listed on each side",
+		append(compareLabels, "side"), nil,
+	)
+	s3CompareMissing = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "compare", "missing_objects"),
+		"The number of objects on one side that are missing from the other",
+		append(compareLabels, "missing_from"), nil,
+	)
+	s3CompareSizeMismatch = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "compare", "size_mismatch_objects"),
+		"The number of objects on both sides with different sizes",
+		compareLabels, nil,
+	)
+	s3CompareETagMismatch = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "compare", "etag_mismatch_objects"),
+		"The number of objects on both sides with the same size but different ETags",
+		compareLabels, nil,
+	)
+	s3CompareETagUnchecked = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "compare", "etag_unchecked_objects"),
+		"The number of objects on both sides with the same size whose ETags couldn't be compared",
+		compareLabels, nil,
+	)
+	s3CompareUnsyncedAge = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "compare", "newest_unsynced_age_seconds"),
+		"How long ago the newest source object that is missing or different at the destination was modified, or 0 if there are none",
+		compareLabels, nil,
+	)
+)
+
+// CompareConfig configures the compare prober
+type CompareConfig struct {
+	// DestinationModule is the module whose storage the destination is read
+	// from. The destination_module parameter overrides it. By default the
+	// destination is read the same way as the source.
+	DestinationModule string `yaml:"destination_module,omitempty"`
+	// IgnoreETags turns off comparing ETags, for when the two sides work
+	// them out differently
+	IgnoreETags bool `yaml:"ignore_etags,omitempty"`
+}
+
+// setupCompare reads the destination of a comparison from the parameters.
+// The destination bucket and prefix default to the source's.
+func (e *Exporter) setupCompare(params url.Values, svc s3iface.S3API, conf *Config, now time.Time) error {
+	if e.delimiter != "" {
+		return errors.New("the compare prober doesn't support a delimiter")
+	}
+
+	e.destBucket = params.Get("destination_bucket")
+	if e.destBucket == "" {
+		e.destBucket = e.bucket
+	}
+	e.destPrefixLabel = e.prefixLabel
+	if _, ok := params["destination_prefix"]; ok {
+		e.destPrefixLabel = params.Get("destination_prefix")
+	}
+	prefix, err := renderTemplate(e.destPrefixLabel, now)
+	if err != nil {
+		return fmt.Errorf("error evaluating destination_prefix template: %s", err)
+	}
+	e.destPrefix = prefix
+
+	name := params.Get("destination_module")
+	if name == "" && e.module.Compare != nil {
+		name = e.module.Compare.DestinationModule
+	}
+	if name == "" {
+		e.destLister = e.lister
+		return nil
+	}
+	module, ok := conf.Modules[name]
+	if !ok {
+		return fmt.Errorf("unknown destination_module %q", name)
+	}
+	e.destLister = module.newLister(svc)
+	return nil
+}
+
+// compareResult is what a comparison found
+type compareResult struct {
+	sourceObjects          int64
+	destinationObjects     int64
+	missingFromSource      int64
+	missingFromDestination int64
+	sizeMismatch           int64
+	etagMismatch           int64
+	etagUnchecked          int64
+	truncated              bool
+	// newestUnsynced is when the newest source object that isn't the same
+	// at the destination was modified
+	newestUnsynced time.Time
+}
+
+// unsynced notes an object in the source that isn't the same at the
+// destination
+func (r *compareResult) unsynced(o *objectInfo) {
+	if o.LastModified.After(r.newestUnsynced) {
+		r.newestUnsynced = o.LastModified
+	}
+}
+
+// objectStream lists a prefix in the background, so that the objects can be
+// read one at a time in step with another listing. Only a page is held in
+// memory at once.
+type objectStream struct {
+	prefix string
+	pages  chan []objectInfo
+	end    chan streamEnd
+	page   []objectInfo
+	// ended is set once the listing has been read to the end
+	ended bool
+	// waited is set once the listing has stopped, and truncated if it
+	// stopped because it ran out of budget. They're only read after
+	// receiving from end, as the listing may still be running until then.
+	waited    bool
+	truncated bool
+	err       error
+}
+
+// streamEnd is how an objectStream's listing stopped
+type streamEnd struct {
+	truncated bool
+	err       error
+}
+
+// newObjectStream starts listing the prefix. Each side of a comparison has
+// the module's budget to itself.
+func (e *Exporter) newObjectStream(ctx context.Context, l ObjectLister, bucket, prefix string) *objectStream {
+	s := &objectStream{
+		prefix: prefix,
+		pages:  make(chan []objectInfo, 1),
+		end:    make(chan streamEnd, 1),
+	}
+	b := &listBudget{
+		maxObjects: e.module.MaxObjects,
+		maxPages:   e.module.MaxPages,
+	}
+	go func() {
+		defer close(s.pages)
+		result := &listResult{}
+		query := listQuery{Bucket: bucket, Prefix: prefix}
+		err := e.listPagesFrom(ctx, l, query, b, result, func(page *listPage) bool {
+			objects := page.Objects
+			for i := range objects {
+				if !b.takeObject() {
+					result.truncated = true
+					objects = objects[:i]
+					break
+				}
+			}
+			select {
+			case s.pages <- objects:
+			case <-ctx.Done():
+				return false
+			}
+			return !result.truncated
+		})
+		s.end <- streamEnd{truncated: result.truncated, err: err}
+	}()
+	return s
+}
+
+// wait waits for the listing to stop
+func (s *objectStream) wait() {
+	if s.waited {
+		return
+	}
+	end := <-s.end
+	s.waited, s.truncated, s.err = true, end.truncated, end.err
+}
+
+// next returns the next object, or nil at the end of the listing
+func (s *objectStream) next() *objectInfo {
+	for len(s.page) == 0 {
+		page, ok := <-s.pages
+		if !ok {
+			s.ended = true
+			s.wait()
+			return nil
+		}
+		s.page = page
+	}
+	o := &s.page[0]
+	s.page = s.page[1:]
+	return o
+}
+
+// compare lists the source and destination side by side in key order,
+// matching up objects by their keys relative to each side's prefix
+func (e *Exporter) compare() (*compareResult, error) {
+	ctx, cancel := context.WithCancel(e.ctx)
+	defer cancel()
+	src := e.newObjectStream(ctx, e.lister, e.bucket, e.prefix)
+	dst := e.newObjectStream(ctx, e.destLister, e.destBucket, e.destPrefix)
+	checkETags := e.module.Compare == nil || !e.module.Compare.IgnoreETags
+
+	r := &compareResult{}
+	s, d := src.next(), dst.next()
+	for s != nil || d != nil {
+		// What's left on one side can't be said to be missing from the
+		// other if the other was cut short
+		if (s == nil && src.truncated) || (d == nil && dst.truncated) {
+			break
+		}
+		var sk, dk string
+		if s != nil {
+			sk = s.Key[len(src.prefix):]
+		}
+		if d != nil {
+			dk = d.Key[len(dst.prefix):]
+		}
+		switch {
+		case d == nil || (s != nil && sk < dk):
+			r.sourceObjects++
+			r.missingFromDestination++
+			r.unsynced(s)
+			s = src.next()
+		case s == nil || dk < sk:
+			r.destinationObjects++
+			r.missingFromSource++
+			d = dst.next()
+		default:
+			r.sourceObjects++
+			r.destinationObjects++
+			switch {
+			case s.Size != d.Size:
+				r.sizeMismatch++
+				r.unsynced(s)
+			case !checkETags || !etagsComparable(s.ETag, d.ETag):
+				r.etagUnchecked++
+			case s.ETag != d.ETag:
+				r.etagMismatch++
+				r.unsynced(s)
+			}
+			s, d = src.next(), dst.next()
+		}
+	}
+	cancel()
+
+	// A listing that wasn't read to the end was stopped on purpose, so
+	// its error is only from being cancelled
+	for _, stream := range []*objectStream{src, dst} {
+		stream.wait()
+		if stream.err != nil && stream.ended {
+			return nil, stream.err
+		}
+	}
+	r.truncated = src.truncated || dst.truncated
+	if err := e.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// etagsComparable reports whether two ETags can be compared to tell if the
+// objects are the same. The ETags of objects uploaded in parts depend on the
+// size of the parts, so they're only compared when neither was.
+func etagsComparable(a, b string) bool {
+	return a != "" && b != "" && !strings.Contains(a, "-") && !strings.Contains(b, "-")
+}
+
+func (e *Exporter) describeCompare(ch chan<- *prometheus.Desc) {
+	ch <- s3CompareSuccess
+	ch <- s3CompareDuration
+	ch <- s3CompareTruncated
+	ch <- s3CompareObjects
+	ch <- s3CompareMissing
+	ch <- s3CompareSizeMismatch
+	ch <- s3CompareETagMismatch
+	ch <- s3CompareETagUnchecked
+	ch <- s3CompareUnsyncedAge
+	if e.prefix != e.prefixLabel {
+		ch <- s3ResolvedPrefix
+	}
+}
+
+// collectCompare compares the source with the destination
+func (e *Exporter) collectCompare(ch chan<- prometheus.Metric) {
+	labels := []string{e.bucket, e.prefixLabel, e.destBucket, e.destPrefixLabel}
+	if e.prefix != e.prefixLabel {
+		ch <- prometheus.MustNewConstMetric(
+			s3ResolvedPrefix, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel, e.prefix,
+		)
+	}
+
+	start := time.Now()
+	r, err := e.compare()
+	observeProbe(e.moduleName, start, err == nil)
+	if err != nil {
+		log.Errorln(err)
+		ch <- prometheus.MustNewConstMetric(s3CompareSuccess, prometheus.GaugeValue, 0, labels...)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(s3CompareSuccess, prometheus.GaugeValue, 1, labels...)
+	ch <- prometheus.MustNewConstMetric(s3CompareDuration, prometheus.GaugeValue, time.Since(start).Seconds(), labels...)
+	ch <- prometheus.MustNewConstMetric(s3CompareTruncated, prometheus.GaugeValue, boolToFloat(r.truncated), labels...)
+	ch <- prometheus.MustNewConstMetric(s3CompareObjects, prometheus.GaugeValue, float64(r.sourceObjects), append(labels, "source")...)
+	ch <- prometheus.MustNewConstMetric(s3CompareObjects, prometheus.GaugeValue, float64(r.destinationObjects), append(labels, "destination")...)
+	ch <- prometheus.MustNewConstMetric(s3CompareMissing, prometheus.GaugeValue, float64(r.missingFromSource), append(labels, "source")...)
+	ch <- prometheus.MustNewConstMetric(s3CompareMissing, prometheus.GaugeValue, float64(r.missingFromDestination), append(labels, "destination")...)
+	ch <- prometheus.MustNewConstMetric(s3CompareSizeMismatch, prometheus.GaugeValue, float64(r.sizeMismatch), labels...)
+	ch <- prometheus.MustNewConstMetric(s3CompareETagMismatch, prometheus.GaugeValue, float64(r.etagMismatch), labels...)
+	ch <- prometheus.MustNewConstMetric(s3CompareETagUnchecked, prometheus.GaugeValue, float64(r.etagUnchecked), labels...)
+	age := 0.0
+	if !r.newestUnsynced.IsZero() {
+		age = time.Since(r.newestUnsynced).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(s3CompareUnsyncedAge, prometheus.GaugeValue, age, labels...)
+}
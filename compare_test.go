@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// compareObjects has a source under a/ and a destination under b/ that
+// differ in every way the compare prober looks for
+func compareObjects() []*s3.Object {
+	base := time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC)
+	var objects []*s3.Object
+	for i, o := range []struct {
+		key  string
+		size int64
+		etag string
+	}{
+		{"a/1", 10, `"11"`}, {"b/1", 10, `"11"`},
+		{"a/2", 10, `"22"`}, {"b/2", 11, `"22"`},
+		{"a/3", 10, `"33"`}, {"b/3", 10, `"34"`},
+		{"a/4", 10, `"44-2"`}, {"b/4", 10, `"44-3"`},
+		{"a/5", 10, `"55"`},
+		{"b/6", 10, `"66"`},
+		{"a/7/x", 10, `"77"`}, {"b/7/x", 10, `"77"`},
+	} {
+		objects = append(objects, &s3.Object{
+			Key:          aws.String(o.key),
+			Size:         aws.Int64(o.size),
+			ETag:         aws.String(o.etag),
+			LastModified: aws.Time(base.Add(time.Duration(i) * time.Hour)),
+		})
+	}
+	return objects
+}
+
+// TestProbeHandlerCompare checks the differences found between two
+// prefixes, and between S3 and a directory
+func TestProbeHandlerCompare(t *testing.T) {
+	root, objects := newFSBucket(t)
+	defer os.RemoveAll(root)
+	svc := newMemS3Client(compareObjects())
+	conf, err := parseConfig([]byte(fmt.Sprintf(`
+modules:
+  compare:
+    prober: compare
+  budget:
+    prober: compare
+    max_objects: 3
+  fs:
+    filesystem:
+      root: %q
+  to_fs:
+    prober: compare
+    compare:
+      destination_module: fs
+`, root)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := `bucket="mock",destination_bucket="mock",destination_prefix="b/",prefix="a/"`
+	fsLabels := `bucket="bucket",destination_bucket="bucket",destination_prefix="",prefix=""`
+	missingFrom := func(labels, side string) string {
+		return strings.Replace(labels, ",prefix=", `,missing_from="`+side+`",prefix=`, 1)
+	}
+	tests := []struct {
+		query    string
+		svc      *memS3Client
+		code     int
+		expected []string
+		missing  []string
+	}{
+		{
+			query: "bucket=mock&module=compare&prefix=a/&destination_prefix=b/",
+			code:  200,
+			expected: []string{
+				`s3_compare_success{` + labels + `} 1`,
+				`s3_compare_truncated{` + labels + `} 0`,
+				`s3_compare_objects{` + labels + `,side="source"} 6`,
+				`s3_compare_objects{` + labels + `,side="destination"} 6`,
+				`s3_compare_missing_objects{` + missingFrom(labels, "source") + `} 1`,
+				`s3_compare_missing_objects{` + missingFrom(labels, "destination") + `} 1`,
+				`s3_compare_size_mismatch_objects{` + labels + `} 1`,
+				`s3_compare_etag_mismatch_objects{` + labels + `} 1`,
+				`s3_compare_etag_unchecked_objects{` + labels + `} 1`,
+			},
+		},
+		{
+			query: "bucket=mock&module=budget&prefix=a/&destination_prefix=b/",
+			code:  200,
+			expected: []string{
+				`s3_compare_truncated{` + labels + `} 1`,
+				`s3_compare_objects{` + labels + `,side="source"} 3`,
+				`s3_compare_objects{` + labels + `,side="destination"} 3`,
+				`s3_compare_missing_objects{` + missingFrom(labels, "source") + `} 0`,
+				`s3_compare_missing_objects{` + missingFrom(labels, "destination") + `} 0`,
+			},
+		},
+		{
+			query: "bucket=bucket&module=to_fs",
+			svc:   newMemS3Client(objects),
+			code:  200,
+			expected: []string{
+				`s3_compare_success{` + fsLabels + `} 1`,
+				`s3_compare_objects{` + fsLabels + `,side="source"} 13`,
+				`s3_compare_objects{` + fsLabels + `,side="destination"} 13`,
+				`s3_compare_missing_objects{` + missingFrom(fsLabels, "source") + `} 0`,
+				`s3_compare_missing_objects{` + missingFrom(fsLabels, "destination") + `} 0`,
+				`s3_compare_size_mismatch_objects{` + fsLabels + `} 0`,
+				`s3_compare_etag_unchecked_objects{` + fsLabels + `} 13`,
+				`s3_compare_newest_unsynced_age_seconds{` + fsLabels + `} 0`,
+			},
+		},
+		{
+			query: "bucket=bucket&module=compare&destination_module=fs&destination_bucket=missing",
+			code:  200,
+			expected: []string{
+				`s3_compare_success{bucket="bucket",destination_bucket="missing",destination_prefix="",prefix=""} 0`,
+			},
+			missing: []string{"s3_compare_objects"},
+		},
+		{query: "bucket=mock&module=compare&destination_module=nope", code: 400},
+		{query: "bucket=mock&module=compare&delimiter=/", code: 400},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", "/probe?"+tc.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		if tc.svc != nil {
+			probeHandler(rr, req, tc.svc, conf, nil, 0)
+		} else {
+			probeHandler(rr, req, svc, conf, nil, 0)
+		}
+		if rr.Code != tc.code {
+			t.Fatalf("%s: expected a %d, got %d: %s", tc.query, tc.code, rr.Code, rr.Body.String())
+		}
+
+		for _, l := range tc.expected {
+			if !strings.Contains(rr.Body.String(), l) {
+				t.Errorf("%s: expected %s in:\n%s", tc.query, l, rr.Body.String())
+			}
+		}
+		for _, l := range tc.missing {
+			if strings.Contains(rr.Body.String(), l) {
+				t.Errorf("%s: didn't expect %s in:\n%s", tc.query, l, rr.Body.String())
+			}
+		}
+	}
+}
+
+// TestCompareNewestUnsynced checks that only source objects that aren't the
+// same at the destination count as unsynced
+func TestCompareNewestUnsynced(t *testing.T) {
+	lister := &s3Lister{svc: newMemS3Client(compareObjects())}
+	e := &Exporter{
+		ctx:        context.Background(),
+		bucket:     "mock",
+		prefix:     "a/",
+		lister:     lister,
+		destBucket: "mock",
+		destPrefix: "b/",
+		destLister: lister,
+	}
+	r, err := e.compare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a/5, which is missing from the destination. b/6 is newer, but it's
+	// only in the destination.
+	expected := time.Date(2026, time.October, 1, 8, 0, 0, 0, time.UTC)
+	if !r.newestUnsynced.Equal(expected) {
+		t.Errorf("expected the newest unsynced object to be from %s, got %s", expected, r.newestUnsynced)
+	}
+
+	e.module.Compare = &CompareConfig{IgnoreETags: true}
+	r, err = e.compare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.etagMismatch != 0 || r.etagUnchecked != 4 {
+		t.Errorf("expected no ETags to be compared, got %+v", r)
+	}
+}
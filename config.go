@@ -0,0 +1,426 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/prometheus/common/model"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultModule = "default"
+
+// Config is the configuration file for the exporter
+type Config struct {
+	Modules map[string]Module `yaml:"modules"`
+}
+
+// Module configures how a probe goes about listing a bucket. Probes choose a
+// module with the module parameter.
+type Module struct {
+	// Prober is how the probe finds the objects to report on: "list" lists
+	// them with ListObjectsV2, "inventory" reads the latest S3 Inventory
+	// report, "head" checks a single key with HeadObject, "content" reads a
+	// single key and checks what's in it, "json" turns the values in a JSON
+	// object into metrics, "textfile" serves the metrics in Prometheus
+	// text format files, "compare" lists two prefixes and compares them,
+	// "cloudwatch" reads the bucket's storage metrics from CloudWatch,
+	// "accesslog" counts the requests in server access logs and
+	// "cloudtrail" counts the S3 data events in CloudTrail log files
+	Prober string `yaml:"prober,omitempty"`
+	// PageSize is the number of keys asked for in each ListObjectsV2
+	// request, up to 1000
+	PageSize int64 `yaml:"page_size,omitempty"`
+	// MaxObjects and MaxPages put a limit on how much a probe lists. When
+	// either is reached the probe stops and reports what it has found so
+	// far as truncated.
+	MaxObjects int64           `yaml:"max_objects,omitempty"`
+	MaxPages   int64           `yaml:"max_pages,omitempty"`
+	Parallel   *ParallelConfig `yaml:"parallel,omitempty"`
+	// StorageClasses has list probes report the objects in each storage
+	// class. Inventory probes always do.
+	StorageClasses bool `yaml:"storage_classes,omitempty"`
+	// Inventory is where to find inventory reports for the inventory prober
+	Inventory *InventoryConfig `yaml:"inventory,omitempty"`
+	// Head configures the head prober
+	Head *HeadConfig `yaml:"head,omitempty"`
+	// Content is what the content prober checks
+	Content *ContentConfig `yaml:"content,omitempty"`
+	// JSON maps values to metrics for the json prober
+	JSON *JSONConfig `yaml:"json,omitempty"`
+	// Textfile configures the textfile prober
+	Textfile *TextfileConfig `yaml:"textfile,omitempty"`
+	// Compare configures the compare prober
+	Compare *CompareConfig `yaml:"compare,omitempty"`
+	// CloudWatch configures the cloudwatch prober
+	CloudWatch *CloudWatchConfig `yaml:"cloudwatch,omitempty"`
+	// AccessLog configures the accesslog prober
+	AccessLog *AccessLogConfig `yaml:"access_log,omitempty"`
+	// CloudTrail configures the cloudtrail prober
+	CloudTrail *CloudTrailConfig `yaml:"cloudtrail,omitempty"`
+	// Incremental only lists the keys after the last one seen by the probe
+	// before
+	Incremental *IncrementalConfig `yaml:"incremental,omitempty"`
+	// State keeps each listing until the next probe, to count the objects
+	// added and removed in between
+	State *StateConfig `yaml:"state,omitempty"`
+	// S3 overrides the flags for connecting to S3 for probes with this
+	// module
+	S3 *S3Config `yaml:"s3,omitempty"`
+	// Filesystem reads from directories on local disk instead of S3
+	Filesystem *FilesystemConfig `yaml:"filesystem,omitempty"`
+	// PrefixOffset moves the time that templates in the prefix and key
+	// parameters are evaluated at back by this much
+	PrefixOffset model.Duration `yaml:"prefix_offset,omitempty"`
+	// Expectations are checked against the objects found by each probe
+	Expectations `yaml:",inline"`
+
+	// client is used for probes with this module, when it has its own S3
+	// config
+	client s3iface.S3API
+	// cloudwatch is used for probes with the cloudwatch prober
+	cloudwatch cloudwatchiface.CloudWatchAPI
+}
+
+// UnmarshalYAML validates a module
+func (m *Module) UnmarshalYAML(value *yaml.Node) error {
+	type plain Module
+	*m = Module{Prober: "list"}
+	if err := value.Decode((*plain)(m)); err != nil {
+		return err
+	}
+
+	switch m.Prober {
+	case "list", "head", "compare":
+	case "inventory":
+		if m.Inventory == nil {
+			return fmt.Errorf("line %d: inventory must be set for the inventory prober", value.Line)
+		}
+	case "content":
+		if m.Content == nil {
+			return fmt.Errorf("line %d: content must be set for the content prober", value.Line)
+		}
+	case "json":
+		if m.JSON == nil {
+			return fmt.Errorf("line %d: json must be set for the json prober", value.Line)
+		}
+	case "textfile":
+		if m.Textfile == nil {
+			m.Textfile = &TextfileConfig{Suffix: ".prom", MaxSize: defaultContentMaxSize}
+		}
+	case "cloudwatch":
+		if m.CloudWatch == nil {
+			m.CloudWatch = &CloudWatchConfig{Lookback: defaultCloudWatchLookback}
+		}
+		if m.Filesystem != nil {
+			return fmt.Errorf("line %d: filesystem doesn't work with the cloudwatch prober", value.Line)
+		}
+	case "accesslog":
+		if m.AccessLog == nil {
+			c := defaultAccessLogConfig
+			m.AccessLog = &c
+		}
+	case "cloudtrail":
+		if m.CloudTrail == nil {
+			return fmt.Errorf("line %d: cloudtrail must be set for the cloudtrail prober", value.Line)
+		}
+	default:
+		return fmt.Errorf("line %d: unknown prober %q", value.Line, m.Prober)
+	}
+
+	if m.PageSize < 0 || m.PageSize > 1000 {
+		return fmt.Errorf("line %d: page_size must be between 0 and 1000 (0 uses the default)", value.Line)
+	}
+	if m.MaxObjects < 0 {
+		return fmt.Errorf("line %d: max_objects can't be negative", value.Line)
+	}
+	if m.MaxPages < 0 {
+		return fmt.Errorf("line %d: max_pages can't be negative", value.Line)
+	}
+	if m.MinObjects < 0 || m.MinSize < 0 {
+		return fmt.Errorf("line %d: min_objects and min_size can't be negative", value.Line)
+	}
+	if m.State != nil && m.Prober != "list" && m.Prober != "inventory" && m.Prober != "accesslog" && m.Prober != "cloudtrail" {
+		return fmt.Errorf("line %d: state only works with the list, inventory, accesslog and cloudtrail probers", value.Line)
+	}
+	if m.StorageClasses && m.Prober != "list" && m.Prober != "inventory" {
+		return fmt.Errorf("line %d: storage_classes only works with the list and inventory probers", value.Line)
+	}
+	if m.Incremental != nil && (m.Prober != "list" || m.Parallel != nil) {
+		return fmt.Errorf("line %d: incremental only works with the list prober, without parallel", value.Line)
+	}
+	if m.S3 != nil && m.Filesystem != nil {
+		return fmt.Errorf("line %d: s3 and filesystem can't both be set", value.Line)
+	}
+
+	return nil
+}
+
+// ParallelConfig turns on parallel listing for a module. The prefix being
+// probed is split into shards which are listed at the same time and then
+// merged back together.
+type ParallelConfig struct {
+	// ShardBy is either "delimiter", which lists each of the common prefixes
+	// found under the prefix separately, or "range", which splits the keys
+	// under the prefix into ranges with StartAfter
+	ShardBy string `yaml:"shard_by"`
+	// Delimiter used to discover sub-prefixes when sharding by delimiter
+	Delimiter string `yaml:"delimiter,omitempty"`
+	// Charset splits the key range on each of these characters, which suits
+	// keys that start with hex digits or UUIDs
+	Charset string `yaml:"charset,omitempty"`
+	// StartAfter splits the key range on each of these keys, relative to the
+	// prefix
+	StartAfter []string `yaml:"start_after,omitempty"`
+	// Workers is how many shards are listed at once
+	Workers int `yaml:"workers,omitempty"`
+}
+
+// UnmarshalYAML sets the defaults for a parallel config and validates it
+func (p *ParallelConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain ParallelConfig
+	*p = ParallelConfig{
+		Delimiter: "/",
+		Workers:   8,
+	}
+	if err := value.Decode((*plain)(p)); err != nil {
+		return err
+	}
+
+	switch p.ShardBy {
+	case "delimiter":
+		if p.Delimiter == "" {
+			return fmt.Errorf("line %d: delimiter can't be empty when sharding by delimiter", value.Line)
+		}
+	case "range":
+		if p.Charset == "" && len(p.StartAfter) == 0 {
+			return fmt.Errorf("line %d: charset or start_after must be set when sharding by range", value.Line)
+		}
+	default:
+		return fmt.Errorf("line %d: unknown shard_by %q, must be one of delimiter or range", value.Line, p.ShardBy)
+	}
+	if p.Workers < 1 {
+		return fmt.Errorf("line %d: workers must be at least 1", value.Line)
+	}
+
+	return nil
+}
+
+// InventoryConfig says where S3 Inventory delivers reports. Reports for a
+// source bucket are found under <prefix>/<source bucket>/<config_id>/, which
+// is the layout S3 uses.
+type InventoryConfig struct {
+	// Bucket the inventory reports are delivered to
+	Bucket string `yaml:"bucket"`
+	// Prefix set on the inventory destination, if any
+	Prefix string `yaml:"prefix,omitempty"`
+	// ConfigID is the name of the inventory configuration
+	ConfigID string `yaml:"config_id"`
+}
+
+// UnmarshalYAML validates an inventory config
+func (i *InventoryConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain InventoryConfig
+	if err := value.Decode((*plain)(i)); err != nil {
+		return err
+	}
+	if i.Bucket == "" {
+		return fmt.Errorf("line %d: inventory bucket must be set", value.Line)
+	}
+	if i.ConfigID == "" {
+		return fmt.Errorf("line %d: inventory config_id must be set", value.Line)
+	}
+	return nil
+}
+
+// FilesystemConfig has probes read from local disk, or a mounted network
+// share. Each directory under the root is a bucket and the paths of the files
+// in it, relative to it, are the keys.
+type FilesystemConfig struct {
+	Root string `yaml:"root"`
+}
+
+// UnmarshalYAML validates a filesystem config
+func (f *FilesystemConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain FilesystemConfig
+	if err := value.Decode((*plain)(f)); err != nil {
+		return err
+	}
+	if f.Root == "" {
+		return fmt.Errorf("line %d: filesystem root must be set", value.Line)
+	}
+	f.Root = filepath.Clean(f.Root)
+	return nil
+}
+
+// boundaries returns the sorted keys that split prefix into ranges
+func (p *ParallelConfig) boundaries(prefix string) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, c := range p.Charset {
+		seen[prefix+string(c)] = true
+	}
+	for _, s := range p.StartAfter {
+		seen[prefix+s] = true
+	}
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setupClients creates a client for each module that has its own S3 config,
+// based on the config given by the flags, and a CloudWatch client for each
+// module with the cloudwatch prober
+func (c *Config) setupClients(sess *session.Session, defaults S3Config, limiter *rate.Limiter) {
+	for name, m := range c.Modules {
+		if m.S3 != nil {
+			m.client = newS3Client(sess, defaults.override(m.S3), limiter)
+		}
+		if m.Prober == "cloudwatch" {
+			m.cloudwatch = newCloudWatchClient(sess, m.CloudWatch)
+		}
+		c.Modules[name] = m
+	}
+}
+
+// defaultConfig is used when no configuration file is given
+func defaultConfig() *Config {
+	return &Config{
+		Modules: map[string]Module{
+			defaultModule: {Prober: "list"},
+		},
+	}
+}
+
+// loadConfig reads and validates the configuration file at path
+func loadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(b)
+}
+
+func parseConfig(b []byte) (*Config, error) {
+	c := &Config{}
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) > 0 {
+		if err := checkFields(&root, reflect.TypeOf(c)); err != nil {
+			return nil, err
+		}
+		if err := root.Decode(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.Modules == nil {
+		c.Modules = map[string]Module{}
+	}
+	if _, ok := c.Modules[defaultModule]; !ok {
+		c.Modules[defaultModule] = Module{Prober: "list"}
+	}
+	for name, m := range c.Modules {
+		if m.Compare == nil || m.Compare.DestinationModule == "" {
+			continue
+		}
+		if _, ok := c.Modules[m.Compare.DestinationModule]; !ok {
+			return nil, fmt.Errorf("module %s: unknown destination_module %q", name, m.Compare.DestinationModule)
+		}
+	}
+	return c, nil
+}
+
+// checkFields walks node alongside the type it will be decoded into and
+// reports any keys that don't match a field. yaml.v3 only does this itself for
+// types that don't have their own UnmarshalYAML. Durations are checked here
+// too, as the errors from parsing them don't say which line they're on.
+func checkFields(node *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	switch {
+	case t == reflect.TypeOf(model.Duration(0)) && node.Kind == yaml.ScalarNode:
+		if _, err := model.ParseDuration(node.Value); err != nil {
+			return fmt.Errorf("line %d: %s", node.Line, err)
+		}
+	case node.Kind == yaml.DocumentNode:
+		for _, n := range node.Content {
+			if err := checkFields(n, t); err != nil {
+				return err
+			}
+		}
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			ft, ok := fields[key.Value]
+			if !ok {
+				return fmt.Errorf("line %d: field %s not found in type %s", key.Line, key.Value, t)
+			}
+			if err := checkFields(node.Content[i+1], ft); err != nil {
+				return err
+			}
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := checkFields(node.Content[i], t.Elem()); err != nil {
+				return err
+			}
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for _, n := range node.Content {
+			if err := checkFields(n, t.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// yamlFields maps the YAML names of the fields in struct type t to their types
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		inline := false
+		for _, flag := range tag[1:] {
+			inline = inline || flag == "inline"
+		}
+		if inline {
+			for name, ft := range yamlFields(f.Type) {
+				fields[name] = ft
+			}
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// TestParseConfig checks defaults are filled in and bad modules are caught
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig([]byte(`
+modules:
+  sharded:
+    parallel:
+      shard_by: delimiter
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Modules[defaultModule]; !ok {
+		t.Errorf("expected the default module to be added")
+	}
+	p := c.Modules["sharded"].Parallel
+	if p == nil || p.Delimiter != "/" || p.Workers != 8 {
+		t.Errorf("expected parallel defaults to be set, got %+v", p)
+	}
+
+	c, err = parseConfig([]byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Modules[defaultModule]; !ok {
+		t.Errorf("expected the default module in an empty config")
+	}
+
+	invalid := map[string]string{
+		"unknown field": `
+modules:
+  foo:
+    bar: baz
+`,
+		"page size too big": `
+modules:
+  foo:
+    page_size: 5000
+`,
+		"unknown shard_by": `
+modules:
+  foo:
+    parallel:
+      shard_by: hash
+`,
+		"range without boundaries": `
+modules:
+  foo:
+    parallel:
+      shard_by: range
+`,
+		"no workers": `
+modules:
+  foo:
+    parallel:
+      shard_by: range
+      charset: abc
+      workers: 0
+`,
+		"bad duration": `
+modules:
+  foo:
+    max_age: 1x
+`,
+		"bad endpoint": `
+modules:
+  foo:
+    s3:
+      endpoint_url: minio:9000
+`,
+		"bad role": `
+modules:
+  foo:
+    s3:
+      role_arn: arn:aws:s3:::bucket
+`,
+		"filesystem without root": `
+modules:
+  foo:
+    filesystem: {}
+`,
+		"state without a store": `
+modules:
+  foo:
+    state: {}
+`,
+		"state with the head prober": `
+modules:
+  foo:
+    prober: head
+    state:
+      directory: /var/lib/s3_exporter
+`,
+		"storage classes for head": `
+modules:
+  foo:
+    prober: head
+    storage_classes: true
+`,
+		"incremental with parallel": `
+modules:
+  foo:
+    incremental: {}
+    parallel:
+      shard_by: delimiter
+`,
+		"incremental relist": `
+modules:
+  foo:
+    incremental:
+      full_relist_every: 0s
+`,
+		"cloudwatch lookback": `
+modules:
+  foo:
+    prober: cloudwatch
+    cloudwatch:
+      lookback: 1h
+`,
+		"cloudwatch with filesystem": `
+modules:
+  foo:
+    prober: cloudwatch
+    filesystem:
+      root: /srv
+`,
+		"access log lookback": `
+modules:
+  foo:
+    prober: accesslog
+    access_log:
+      lookback: 0s
+`,
+		"cloudtrail without buckets": `
+modules:
+  foo:
+    prober: cloudtrail
+    cloudtrail:
+      lookback: 1h
+`,
+		"cloudtrail missing": `
+modules:
+  foo:
+    prober: cloudtrail
+`,
+		"filesystem and s3": `
+modules:
+  foo:
+    s3:
+      region: eu-west-1
+    filesystem:
+      root: /mnt/backups
+`,
+	}
+	for name, conf := range invalid {
+		if _, err := parseConfig([]byte(conf)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if !strings.Contains(err.Error(), "line ") {
+			t.Errorf("%s: expected the error to include a line number, got %s", name, err)
+		}
+	}
+}
+
+// TestSetupClients checks that modules with their own S3 config get a client
+// that combines it with the flags
+func TestSetupClients(t *testing.T) {
+	c, err := parseConfig([]byte(`
+modules:
+  minio:
+    s3:
+      endpoint_url: http://minio:9000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.setupClients(session.Must(session.NewSession()), S3Config{Region: "eu-west-1", ForcePathStyle: true}, nil)
+
+	if c.Modules[defaultModule].client != nil {
+		t.Errorf("didn't expect a client for the default module")
+	}
+	svc, ok := c.Modules["minio"].client.(*s3.S3)
+	if !ok {
+		t.Fatalf("expected a client for the minio module")
+	}
+	if svc.Endpoint != "http://minio:9000" || aws.StringValue(svc.Config.Region) != "eu-west-1" || !aws.BoolValue(svc.Config.S3ForcePathStyle) {
+		t.Errorf("unexpected client config: %s %s %v", svc.Endpoint, aws.StringValue(svc.Config.Region), aws.BoolValue(svc.Config.S3ForcePathStyle))
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultContentMaxSize is how much of an object the content prober reads
+// when max_size isn't set
+const defaultContentMaxSize = 1 << 20
+
+var (
+	s3ContentReadSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "object_content_read_success"),
+		"If the object was read successfully",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3ContentReadDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "object_content_read_duration_seconds"),
+		"How long it took to read the object",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3ContentReadBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "object_content_read_bytes"),
+		"The number of bytes of the object that were read, before decompression",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3ContentMatch = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "object_content_match"),
+		"If the content of the object passed every assertion",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3ContentAssertionMatch = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "object_content_assertion_match"),
+		"If the content of the object passed each assertion",
+		[]string{"bucket", "key", "assertion"}, nil,
+	)
+)
+
+// ContentConfig configures the content prober, which reads an object and
+// checks what's in it
+type ContentConfig struct {
+	// Range is an HTTP byte range to read rather than the whole object, like
+	// "bytes=0-1023"
+	Range string `yaml:"range,omitempty"`
+	// MaxSize is the most bytes that will be read, both from S3 and after
+	// decompression. Objects that are bigger fail the probe.
+	MaxSize int64 `yaml:"max_size,omitempty"`
+	// Gzip decompresses the object before the assertions are checked
+	Gzip       bool               `yaml:"gzip,omitempty"`
+	Assertions []ContentAssertion `yaml:"assertions"`
+}
+
+// UnmarshalYAML sets the defaults for a content config and validates it
+func (c *ContentConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain ContentConfig
+	*c = ContentConfig{MaxSize: defaultContentMaxSize}
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("line %d: max_size must be positive", value.Line)
+	}
+	if c.Range != "" && !strings.HasPrefix(c.Range, "bytes=") {
+		return fmt.Errorf("line %d: range %q must be a byte range like bytes=0-1023", value.Line, c.Range)
+	}
+	if len(c.Assertions) == 0 {
+		return fmt.Errorf("line %d: content needs at least one assertion", value.Line)
+	}
+	names := map[string]bool{}
+	for i := range c.Assertions {
+		a := &c.Assertions[i]
+		if a.Name == "" {
+			a.Name = fmt.Sprintf("%d", i)
+		}
+		if names[a.Name] {
+			return fmt.Errorf("line %d: duplicate assertion name %q", value.Line, a.Name)
+		}
+		names[a.Name] = true
+	}
+	return nil
+}
+
+// ContentAssertion is something that should be true of the content of an
+// object. The value that's checked is the whole body, or the result of the
+// JMESPath expression when there is one, which must then be true, equal to
+// Equals or match Regex.
+type ContentAssertion struct {
+	// Name is used for the assertion label, and defaults to the position of
+	// the assertion in the list
+	Name string `yaml:"name,omitempty"`
+	// Regex must match the value
+	Regex string `yaml:"regex,omitempty"`
+	// JMESPath is evaluated against the body parsed as JSON
+	JMESPath string `yaml:"jmespath,omitempty"`
+	// Equals is what the result of the JMESPath expression should be.
+	// Strings are compared as they are and anything else as JSON.
+	Equals *string `yaml:"equals,omitempty"`
+	// SHA256 is the checksum the object should have, as it's stored
+	SHA256 string `yaml:"sha256,omitempty"`
+	// SHA256Suffix names an object next to the one being checked, with this
+	// suffix added to its key, that holds the checksum the object should
+	// have. The checksum is the first word of the object, as written by
+	// sha256sum.
+	SHA256Suffix string `yaml:"sha256_suffix,omitempty"`
+
+	regex    *regexp.Regexp
+	jmespath *jmespath.JMESPath
+}
+
+// UnmarshalYAML compiles and validates an assertion
+func (a *ContentAssertion) UnmarshalYAML(value *yaml.Node) error {
+	type plain ContentAssertion
+	if err := value.Decode((*plain)(a)); err != nil {
+		return err
+	}
+
+	checksum := a.SHA256 != "" || a.SHA256Suffix != ""
+	if checksum && (a.Regex != "" || a.JMESPath != "" || a.Equals != nil) {
+		return fmt.Errorf("line %d: a checksum assertion can't also have regex, jmespath or equals", value.Line)
+	}
+	if a.SHA256 != "" && a.SHA256Suffix != "" {
+		return fmt.Errorf("line %d: only one of sha256 and sha256_suffix can be set", value.Line)
+	}
+	if a.SHA256 != "" {
+		if b, err := hex.DecodeString(a.SHA256); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("line %d: sha256 %q isn't a SHA-256 checksum in hex", value.Line, a.SHA256)
+		}
+	}
+	if !checksum && a.Regex == "" && a.JMESPath == "" {
+		return fmt.Errorf("line %d: an assertion needs one of regex, jmespath, sha256 or sha256_suffix", value.Line)
+	}
+	if a.Equals != nil && a.JMESPath == "" {
+		return fmt.Errorf("line %d: equals can only be used with jmespath", value.Line)
+	}
+	if a.Equals != nil && a.Regex != "" {
+		return fmt.Errorf("line %d: only one of equals and regex can be set", value.Line)
+	}
+
+	var err error
+	if a.Regex != "" {
+		if a.regex, err = regexp.Compile(a.Regex); err != nil {
+			return fmt.Errorf("line %d: invalid regex: %s", value.Line, err)
+		}
+	}
+	if a.JMESPath != "" {
+		if a.jmespath, err = jmespath.Compile(a.JMESPath); err != nil {
+			return fmt.Errorf("line %d: invalid jmespath: %s", value.Line, err)
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) describeContent(ch chan<- *prometheus.Desc) {
+	ch <- s3ContentReadSuccess
+	ch <- s3ContentReadDuration
+	ch <- s3ContentReadBytes
+	ch <- s3ContentMatch
+	ch <- s3ContentAssertionMatch
+	if e.key != e.keyLabel {
+		ch <- s3ResolvedKey
+	}
+}
+
+// collectContent reads an object and checks its content against the
+// module's assertions
+func (e *Exporter) collectContent(ch chan<- prometheus.Metric) {
+	if e.key != e.keyLabel {
+		ch <- prometheus.MustNewConstMetric(
+			s3ResolvedKey, prometheus.GaugeValue, 1, e.bucket, e.keyLabel, e.key,
+		)
+	}
+
+	conf := e.module.Content
+	start := time.Now()
+	raw, err := e.readObject(e.key, conf.Range, conf.MaxSize)
+	var body []byte
+	if err == nil {
+		body = raw
+		if conf.Gzip {
+			body, err = gunzip(raw, conf.MaxSize)
+		}
+	}
+	duration := time.Since(start).Seconds()
+	observeProbe(e.moduleName, start, err == nil)
+
+	if err != nil {
+		log.Errorln(err)
+		ch <- prometheus.MustNewConstMetric(
+			s3ContentReadSuccess, prometheus.GaugeValue, 0, e.bucket, e.keyLabel,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			s3ContentMatch, prometheus.GaugeValue, 0, e.bucket, e.keyLabel,
+		)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		s3ContentReadSuccess, prometheus.GaugeValue, 1, e.bucket, e.keyLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3ContentReadDuration, prometheus.GaugeValue, duration, e.bucket, e.keyLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3ContentReadBytes, prometheus.GaugeValue, float64(len(raw)), e.bucket, e.keyLabel,
+	)
+
+	match := 1.0
+	for _, a := range conf.Assertions {
+		ok, err := e.checkAssertion(a, raw, body)
+		if err != nil {
+			log.Errorf("assertion %s on s3://%s/%s: %s", a.Name, e.bucket, e.key, err)
+		}
+		v := 0.0
+		if ok {
+			v = 1
+		} else {
+			match = 0
+		}
+		ch <- prometheus.MustNewConstMetric(
+			s3ContentAssertionMatch, prometheus.GaugeValue, v, e.bucket, e.keyLabel, a.Name,
+		)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		s3ContentMatch, prometheus.GaugeValue, match, e.bucket, e.keyLabel,
+	)
+}
+
+// checkAssertion checks a single assertion. Checksums are worked out from
+// the object as it's stored and everything else from the decompressed body.
+func (e *Exporter) checkAssertion(a ContentAssertion, raw, body []byte) (bool, error) {
+	switch {
+	case a.SHA256 != "":
+		sum := sha256.Sum256(raw)
+		return strings.EqualFold(hex.EncodeToString(sum[:]), a.SHA256), nil
+	case a.SHA256Suffix != "":
+		b, err := e.readObject(e.key+a.SHA256Suffix, "", 1024)
+		if err != nil {
+			return false, err
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) == 0 {
+			return false, fmt.Errorf("checksum object %s is empty", e.key+a.SHA256Suffix)
+		}
+		sum := sha256.Sum256(raw)
+		return strings.EqualFold(hex.EncodeToString(sum[:]), fields[0]), nil
+	case a.jmespath != nil:
+		var data interface{}
+		if err := json.Unmarshal(body, &data); err != nil {
+			return false, fmt.Errorf("error parsing content as JSON: %s", err)
+		}
+		result, err := a.jmespath.Search(data)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case a.Equals != nil:
+			return jsonText(result) == *a.Equals, nil
+		case a.regex != nil:
+			return a.regex.MatchString(jsonText(result)), nil
+		default:
+			return truthy(result), nil
+		}
+	default:
+		return a.regex.Match(body), nil
+	}
+}
+
+// readObject reads up to maxSize bytes of an object, and fails if there's
+// more than that
+func (e *Exporter) readObject(key, byteRange string, maxSize int64) ([]byte, error) {
+	body, err := e.lister.Get(e.ctx, e.bucket, key, byteRange)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > maxSize {
+		return nil, fmt.Errorf("s3://%s/%s is bigger than the max_size of %d bytes", e.bucket, key, maxSize)
+	}
+	return b, nil
+}
+
+// gunzip decompresses b, which mustn't decompress to more than maxSize bytes
+func gunzip(b []byte, maxSize int64) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing content: %s", err)
+	}
+	defer gz.Close()
+
+	out, err := ioutil.ReadAll(io.LimitReader(gz, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing content: %s", err)
+	}
+	if int64(len(out)) > maxSize {
+		return nil, fmt.Errorf("content decompresses to more than the max_size of %d bytes", maxSize)
+	}
+	return out, nil
+}
+
+// jsonText renders the result of a JMESPath expression as text. Strings are
+// returned as they are and anything else as JSON.
+func jsonText(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// truthy follows JMESPath's idea of truth: null, false and empty strings,
+// arrays and objects are false
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case string:
+		return t != ""
+	case []interface{}:
+		return len(t) > 0
+	case map[string]interface{}:
+		return len(t) > 0
+	default:
+		return true
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestProbeHandlerContent checks each kind of assertion against objects that
+// pass and fail them
+func TestProbeHandlerContent(t *testing.T) {
+	health := []byte(`{"status":"ok","checks":{"db":true,"queue":false},"count":3}`)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(health)
+	w.Close()
+	sum := sha256.Sum256([]byte("dump"))
+
+	svc := newMemS3Client(nil)
+	svc.bodies = map[string][]byte{
+		"health.json":    health,
+		"health.json.gz": gz.Bytes(),
+		"unhealthy.json": []byte(`{"status":"degraded","checks":{"db":false}}`),
+		"big.json":       bytes.Repeat([]byte(" "), 100),
+		"dump":           []byte("dump"),
+		"dump.sha256":    []byte(hex.EncodeToString(sum[:]) + "  dump\n"),
+		"bad.sha256":     []byte("0000  bad\n"),
+		"bad":            []byte("dump"),
+	}
+	conf, err := parseConfig([]byte(`
+modules:
+  health:
+    prober: content
+    content:
+      max_size: 64
+      assertions:
+        - regex: '"status":\s*"ok"'
+        - name: db
+          jmespath: checks.db
+        - jmespath: count
+          equals: "3"
+  health_gz:
+    prober: content
+    content:
+      gzip: true
+      assertions:
+        - jmespath: status
+          equals: ok
+  head_only:
+    prober: content
+    content:
+      range: bytes=0-12
+      assertions:
+        - regex: '^\{"status":"ok'
+  checksum:
+    prober: content
+    content:
+      assertions:
+        - sha256_suffix: .sha256
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		module   string
+		key      string
+		expected []string
+	}{
+		{
+			module: "health",
+			key:    "health.json",
+			expected: []string{
+				`s3_object_content_read_success{bucket="mock",key="health.json"} 1`,
+				`s3_object_content_read_bytes{bucket="mock",key="health.json"} 60`,
+				`s3_object_content_assertion_match{assertion="0",bucket="mock",key="health.json"} 1`,
+				`s3_object_content_assertion_match{assertion="db",bucket="mock",key="health.json"} 1`,
+				`s3_object_content_assertion_match{assertion="2",bucket="mock",key="health.json"} 1`,
+				`s3_object_content_match{bucket="mock",key="health.json"} 1`,
+			},
+		},
+		{
+			module: "health",
+			key:    "unhealthy.json",
+			expected: []string{
+				`s3_object_content_read_success{bucket="mock",key="unhealthy.json"} 1`,
+				`s3_object_content_assertion_match{assertion="0",bucket="mock",key="unhealthy.json"} 0`,
+				`s3_object_content_assertion_match{assertion="db",bucket="mock",key="unhealthy.json"} 0`,
+				`s3_object_content_assertion_match{assertion="2",bucket="mock",key="unhealthy.json"} 0`,
+				`s3_object_content_match{bucket="mock",key="unhealthy.json"} 0`,
+			},
+		},
+		{
+			module: "health",
+			key:    "big.json",
+			expected: []string{
+				`s3_object_content_read_success{bucket="mock",key="big.json"} 0`,
+				`s3_object_content_match{bucket="mock",key="big.json"} 0`,
+			},
+		},
+		{
+			module: "health",
+			key:    "missing.json",
+			expected: []string{
+				`s3_object_content_read_success{bucket="mock",key="missing.json"} 0`,
+				`s3_object_content_match{bucket="mock",key="missing.json"} 0`,
+			},
+		},
+		{
+			module: "health_gz",
+			key:    "health.json.gz",
+			expected: []string{
+				`s3_object_content_read_bytes{bucket="mock",key="health.json.gz"} ` + strconv.Itoa(gz.Len()),
+				`s3_object_content_match{bucket="mock",key="health.json.gz"} 1`,
+			},
+		},
+		{
+			module: "health_gz",
+			key:    "health.json",
+			expected: []string{
+				`s3_object_content_read_success{bucket="mock",key="health.json"} 0`,
+			},
+		},
+		{
+			module: "head_only",
+			key:    "health.json",
+			expected: []string{
+				`s3_object_content_read_bytes{bucket="mock",key="health.json"} 13`,
+				`s3_object_content_match{bucket="mock",key="health.json"} 1`,
+			},
+		},
+		{
+			module: "checksum",
+			key:    "dump",
+			expected: []string{
+				`s3_object_content_match{bucket="mock",key="dump"} 1`,
+			},
+		},
+		{
+			module: "checksum",
+			key:    "bad",
+			expected: []string{
+				`s3_object_content_match{bucket="mock",key="bad"} 0`,
+			},
+		},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", "/probe?bucket=mock&module="+tc.module+"&key="+tc.key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, svc, conf, nil, 0)
+
+		for _, l := range tc.expected {
+			if !strings.Contains(rr.Body.String(), l) {
+				t.Errorf("%s %s: expected %s", tc.module, tc.key, l)
+			}
+		}
+	}
+}
+
+// TestParseContentConfig checks that bad assertions are caught when the
+// configuration is loaded
+func TestParseContentConfig(t *testing.T) {
+	invalid := map[string]string{
+		"no content": `
+modules:
+  foo:
+    prober: content
+`,
+		"no assertions": `
+modules:
+  foo:
+    prober: content
+    content:
+      max_size: 10
+`,
+		"bad regex": `
+modules:
+  foo:
+    prober: content
+    content:
+      assertions:
+        - regex: '('
+`,
+		"bad jmespath": `
+modules:
+  foo:
+    prober: content
+    content:
+      assertions:
+        - jmespath: 'a.['
+`,
+		"equals without jmespath": `
+modules:
+  foo:
+    prober: content
+    content:
+      assertions:
+        - equals: ok
+`,
+		"bad checksum": `
+modules:
+  foo:
+    prober: content
+    content:
+      assertions:
+        - sha256: abc
+`,
+	}
+	for name, conf := range invalid {
+		if _, err := parseConfig([]byte(conf)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if !strings.Contains(err.Error(), "line ") {
+			t.Errorf("%s: expected the error to include a line number, got %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3Host is the host name clients use for virtual hosted style requests
+// to fakeS3
+const fakeS3Host = "s3.fake.test"
+
+// fakeS3 is an in-process S3 API for tests to drive the real client against.
+// It understands path style and virtual hosted style requests for the
+// operations the exporter uses.
+type fakeS3 struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*fakeObject
+	faults  map[string][]fakeFault
+}
+
+// fakeObject is an object stored in fakeS3
+type fakeObject struct {
+	body         []byte
+	lastModified time.Time
+	storageClass string
+	metadata     map[string]string
+}
+
+// fakeFault is an error response that fakeS3 returns instead of handling a
+// request
+type fakeFault struct {
+	status int
+	code   string
+}
+
+func newFakeS3() *fakeS3 {
+	f := &fakeS3{
+		buckets: map[string]map[string]*fakeObject{},
+		faults:  map[string][]fakeFault{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// put stores an object, creating the bucket if it doesn't exist
+func (f *fakeS3) put(bucket, key string, obj *fakeObject) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buckets[bucket] == nil {
+		f.buckets[bucket] = map[string]*fakeObject{}
+	}
+	f.buckets[bucket][key] = obj
+}
+
+// fail makes the next requests for an operation fail, one for each code given
+func (f *fakeS3) fail(operation string, status int, codes ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, code := range codes {
+		f.faults[operation] = append(f.faults[operation], fakeFault{status: status, code: code})
+	}
+}
+
+// session returns a session for talking to the fake. Virtual hosted style
+// requests go to hosts under fakeS3Host, so every connection is sent to the
+// fake whatever host it's for.
+func (f *fakeS3) session() *session.Session {
+	addr := f.Listener.Addr().String()
+	return session.Must(session.NewSession(aws.NewConfig().
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithRegion("us-east-1").
+		WithHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, addr)
+				},
+			},
+		}),
+	))
+}
+
+func (f *fakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key := f.parse(r)
+
+	operation := ""
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		operation = "ListBuckets"
+	case key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		operation = "ListObjectsV2"
+	case key != "" && r.Method == http.MethodHead:
+		operation = "HeadObject"
+	case key != "" && r.Method == http.MethodGet:
+		operation = "GetObject"
+	default:
+		f.error(w, r, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if faults := f.faults[operation]; len(faults) > 0 {
+		f.faults[operation] = faults[1:]
+		f.error(w, r, faults[0].status, faults[0].code)
+		return
+	}
+
+	if operation == "ListBuckets" {
+		f.listBuckets(w)
+		return
+	}
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		f.error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	switch operation {
+	case "ListObjectsV2":
+		f.listObjects(w, r, bucket, objects)
+	case "HeadObject":
+		f.headObject(w, r, objects[key])
+	case "GetObject":
+		f.getObject(w, r, objects[key])
+	}
+}
+
+// parse works out the bucket and key of a request in either style
+func (f *fakeS3) parse(r *http.Request) (string, string) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if host := strings.Split(r.Host, ":")[0]; strings.HasSuffix(host, "."+fakeS3Host) {
+		return strings.TrimSuffix(host, "."+fakeS3Host), path
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (f *fakeS3) listBuckets(w http.ResponseWriter) {
+	type bucket struct {
+		Name string `xml:"Name"`
+	}
+	result := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{}
+	for name := range f.buckets {
+		result.Buckets = append(result.Buckets, bucket{Name: name})
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool { return result.Buckets[i].Name < result.Buckets[j].Name })
+	xml.NewEncoder(w).Encode(result)
+}
+
+// listObjects pages through the keys in order, using the key to carry on
+// from as the continuation token
+func (f *fakeS3) listObjects(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*fakeObject) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	maxKeys := 1000
+	if v := q.Get("max-keys"); v != "" {
+		maxKeys, _ = strconv.Atoi(v)
+	}
+	after := q.Get("start-after")
+	if token := q.Get("continuation-token"); token != "" {
+		after = token
+	}
+
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		Size         int    `xml:"Size"`
+		StorageClass string `xml:"StorageClass,omitempty"`
+	}
+	type commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+	result := struct {
+		XMLName               xml.Name       `xml:"ListBucketResult"`
+		Name                  string         `xml:"Name"`
+		Prefix                string         `xml:"Prefix"`
+		Delimiter             string         `xml:"Delimiter,omitempty"`
+		MaxKeys               int            `xml:"MaxKeys"`
+		KeyCount              int            `xml:"KeyCount"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+		Contents              []content      `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	}{Name: bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys}
+
+	var keys []string
+	for k := range objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	last := ""
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) || k <= after {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				cp := k[:len(prefix)+i+len(delimiter)]
+				if cp == last || cp <= after {
+					continue
+				}
+				if result.KeyCount == maxKeys {
+					result.IsTruncated = true
+					break
+				}
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: cp})
+				result.KeyCount++
+				last = cp
+				continue
+			}
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		o := objects[k]
+		result.Contents = append(result.Contents, content{
+			Key:          k,
+			LastModified: o.lastModified.UTC().Format(time.RFC3339),
+			Size:         len(o.body),
+			StorageClass: o.storageClass,
+		})
+		result.KeyCount++
+		last = k
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = last
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) headObject(w http.ResponseWriter, r *http.Request, o *fakeObject) {
+	if o == nil {
+		f.error(w, r, http.StatusNotFound, "NotFound")
+		return
+	}
+	f.objectHeaders(w, o, len(o.body))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeS3) getObject(w http.ResponseWriter, r *http.Request, o *fakeObject) {
+	if o == nil {
+		f.error(w, r, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	body := o.body
+	status := http.StatusOK
+	if v := r.Header.Get("Range"); v != "" {
+		var first, last int
+		if _, err := fmt.Sscanf(v, "bytes=%d-%d", &first, &last); err != nil || first >= len(body) {
+			f.error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		if last >= len(body) {
+			last = len(body) - 1
+		}
+		body = body[first : last+1]
+		status = http.StatusPartialContent
+	}
+	f.objectHeaders(w, o, len(body))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (f *fakeS3) objectHeaders(w http.ResponseWriter, o *fakeObject, length int) {
+	w.Header().Set("Content-Length", strconv.Itoa(length))
+	w.Header().Set("Last-Modified", o.lastModified.UTC().Format(http.TimeFormat))
+	for k, v := range o.metadata {
+		w.Header().Set("X-Amz-Meta-"+k, v)
+	}
+}
+
+// newFakeS3Client creates a client for the fake the same way the exporter
+// creates its client from the flags
+func newFakeS3Client(f *fakeS3, pathStyle bool) *s3.S3 {
+	sess := f.session()
+	endpoint := f.URL
+	if !pathStyle {
+		// Virtual hosted style needs a host name to put the bucket in front of
+		endpoint = strings.Replace(f.URL, "127.0.0.1", fakeS3Host, 1)
+	}
+	svc := newS3Client(sess, S3Config{EndpointURL: endpoint, ForcePathStyle: pathStyle}, nil)
+	svc.Retryer = client.DefaultRetryer{
+		NumMaxRetries:    3,
+		MinRetryDelay:    time.Millisecond,
+		MaxRetryDelay:    time.Millisecond,
+		MinThrottleDelay: time.Millisecond,
+		MaxThrottleDelay: time.Millisecond,
+	}
+	return svc
+}
+
+// TestFakeS3 drives probes through the real client against the fake, in both
+// path style and virtual hosted style
+func TestFakeS3(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	base := time.Date(2026, time.October, 10, 2, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		f.put("backups", fmt.Sprintf("daily/2026-10-%02d.tar.gz", 10+i), &fakeObject{
+			body:         []byte(strings.Repeat("x", 10+i)),
+			lastModified: base.AddDate(0, 0, i),
+			storageClass: "STANDARD",
+		})
+	}
+	f.put("backups", "weekly/2026-10-11.tar.gz", &fakeObject{body: []byte("weekly"), lastModified: base})
+	f.put("backups", "latest.json", &fakeObject{
+		body:         []byte(`{"status":"ok"}`),
+		lastModified: base,
+		metadata:     map[string]string{"Backup-Id": "42"},
+	})
+
+	conf, err := parseConfig([]byte(`
+modules:
+  default:
+    # Small pages, so that listings take several requests
+    page_size: 2
+    storage_classes: true
+  head:
+    prober: head
+    head:
+      metadata: [backup-id]
+  content:
+    prober: content
+    content:
+      range: bytes=0-5
+      assertions:
+        - regex: '^\{"stat'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		faults   []string
+		status   int
+		expected []string
+	}{
+		{
+			name:  "paginated listing",
+			query: "bucket=backups&prefix=daily/",
+			expected: []string{
+				`s3_list_success{bucket="backups",delimiter="",prefix="daily/"} 1`,
+				`s3_objects{bucket="backups",prefix="daily/"} 7`,
+				`s3_objects_size_sum_bytes{bucket="backups",prefix="daily/"} 91`,
+				`s3_biggest_object_size_bytes{bucket="backups",prefix="daily/"} 16`,
+				`s3_last_modified_object_date{bucket="backups",prefix="daily/"} 1.792116e+09`,
+				`s3_storage_class_objects{bucket="backups",prefix="daily/",storage_class="STANDARD"} 7`,
+			},
+		},
+		{
+			name:  "delimiter",
+			query: "bucket=backups&delimiter=/",
+			expected: []string{
+				`s3_common_prefixes{bucket="backups",delimiter="/",prefix=""} 2`,
+			},
+		},
+		{
+			name:  "head",
+			query: "bucket=backups&module=head&key=latest.json",
+			expected: []string{
+				`s3_object_exists{bucket="backups",key="latest.json"} 1`,
+				`s3_object_size_bytes{bucket="backups",key="latest.json"} 15`,
+				`s3_object_metadata_info{bucket="backups",key="latest.json",name="backup-id",value="42"} 1`,
+			},
+		},
+		{
+			name:  "head missing",
+			query: "bucket=backups&module=head&key=missing.json",
+			expected: []string{
+				`s3_head_success{bucket="backups",key="missing.json"} 1`,
+				`s3_object_exists{bucket="backups",key="missing.json"} 0`,
+			},
+		},
+		{
+			name:  "content range",
+			query: "bucket=backups&module=content&key=latest.json",
+			expected: []string{
+				`s3_object_content_read_bytes{bucket="backups",key="latest.json"} 6`,
+				`s3_object_content_match{bucket="backups",key="latest.json"} 1`,
+			},
+		},
+		{
+			name:  "no such bucket",
+			query: "bucket=missing&prefix=daily/",
+			expected: []string{
+				`s3_list_success{bucket="missing",delimiter="",prefix="daily/"} 0`,
+				`s3_list_failure{bucket="missing",delimiter="",prefix="daily/",reason="error"} 1`,
+			},
+		},
+		{
+			name:   "throttled then retried",
+			query:  "bucket=backups&prefix=daily/",
+			faults: []string{"SlowDown", "SlowDown"},
+			status: http.StatusServiceUnavailable,
+			expected: []string{
+				`s3_list_success{bucket="backups",delimiter="",prefix="daily/"} 1`,
+				`s3_objects{bucket="backups",prefix="daily/"} 7`,
+			},
+		},
+		{
+			name:   "access denied",
+			query:  "bucket=backups&prefix=daily/",
+			faults: []string{"AccessDenied"},
+			status: http.StatusForbidden,
+			expected: []string{
+				`s3_list_success{bucket="backups",delimiter="",prefix="daily/"} 0`,
+			},
+		},
+	}
+	for _, pathStyle := range []bool{true, false} {
+		svc := newFakeS3Client(f, pathStyle)
+		for _, tc := range tests {
+			f.fail("ListObjectsV2", tc.status, tc.faults...)
+
+			req, err := http.NewRequest("GET", "/probe?"+tc.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			probeHandler(rr, req, svc, conf, nil, 0)
+
+			for _, l := range tc.expected {
+				if !strings.Contains(rr.Body.String(), l) {
+					t.Errorf("%s (path style %v): expected %s", tc.name, pathStyle, l)
+				}
+			}
+		}
+	}
+}
+
+// TestFakeS3Discovery checks that every bucket is turned into a target
+func TestFakeS3Discovery(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+	f.put("backups", "a", &fakeObject{lastModified: time.Now()})
+	f.put("logs", "a", &fakeObject{lastModified: time.Now()})
+
+	req, err := http.NewRequest("GET", "/discovery", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "exporter:9340"
+	rr := httptest.NewRecorder()
+	discoveryHandler(rr, req, newFakeS3Client(f, true))
+
+	expected := `[{"targets":["exporter:9340"],"labels":{"__param_bucket":"backups"}},{"targets":["exporter:9340"],"labels":{"__param_bucket":"logs"}}]`
+	if rr.Body.String() != expected {
+		t.Errorf("expected %s, got %s", expected, rr.Body.String())
+	}
+}
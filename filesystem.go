@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultFSPageSize is how many objects and common prefixes there are in a
+// page of a filesystem listing, as there are for S3
+const defaultFSPageSize = 1000
+
+// errStopWalk ends a walk once fn doesn't want any more pages
+var errStopWalk = errors.New("listing stopped")
+
+// fsLister reads a directory tree as if it were S3. Each directory under
+// root is a bucket, and the files in it are objects with their path relative
+// to the bucket, separated by slashes, as the key and their mtime as when
+// they were last modified. Symbolic links aren't followed, so nothing
+// outside of root can be read.
+type fsLister struct {
+	root string
+}
+
+// bucketDir returns the directory for a bucket
+func (l *fsLister) bucketDir(bucket string) (string, error) {
+	if bucket == "" || bucket == "." || bucket == ".." || strings.ContainsAny(bucket, `/\`) {
+		return "", fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	dir := filepath.Join(l.root, bucket)
+	fi, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("bucket %s doesn't exist in %s", bucket, l.root)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("bucket %s isn't a directory in %s", bucket, l.root)
+	}
+	return dir, nil
+}
+
+// objectFile returns the path and details of the file for an object. Keys
+// that can't be a file in the bucket's directory, or that go through a
+// symbolic link, don't exist.
+func (l *fsLister) objectFile(bucket, key string) (string, os.FileInfo, error) {
+	path, err := l.bucketDir(bucket)
+	if err != nil {
+		return "", nil, err
+	}
+	notFound := fmt.Errorf("%w: %s/%s", errNotFound, bucket, key)
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.ContainsRune(part, filepath.Separator) {
+			return "", nil, notFound
+		}
+		path = filepath.Join(path, part)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return "", nil, notFound
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if i < len(parts)-1 && !fi.IsDir() {
+			return "", nil, notFound
+		}
+		if i == len(parts)-1 {
+			if !fi.Mode().IsRegular() {
+				return "", nil, notFound
+			}
+			return path, fi, nil
+		}
+	}
+	return "", nil, notFound
+}
+
+// Head returns the size and mtime of the file for an object
+func (l *fsLister) Head(ctx context.Context, bucket, key string) (*objectInfo, error) {
+	_, fi, err := l.objectFile(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &objectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}, nil
+}
+
+// sectionReadCloser reads a section of a file
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// Get opens the file for an object
+func (l *fsLister) Get(ctx context.Context, bucket, key, byteRange string) (io.ReadCloser, error) {
+	path, fi, err := l.objectFile(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange == "" {
+		return f, nil
+	}
+	offset, length, err := parseByteRange(byteRange, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sectionReadCloser{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+// parseByteRange parses a single range in the format of an HTTP Range
+// header, for an object of the given size, into where the range starts and
+// how long it is. As with S3, a range that runs past the end of the object
+// stops at the end, but one that starts past the end is an error.
+func parseByteRange(byteRange string, size int64) (int64, int64, error) {
+	invalid := fmt.Errorf("invalid range %q for an object of %d bytes", byteRange, size)
+	spec := strings.TrimPrefix(byteRange, "bytes=")
+	i := strings.Index(spec, "-")
+	if spec == byteRange || i < 0 {
+		return 0, 0, invalid
+	}
+	first, last := spec[:i], spec[i+1:]
+	if first == "" {
+		// The last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, invalid
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, invalid
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, invalid
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, nil
+}
+
+// ListPages walks the bucket's directory in key order. Only the directories
+// that can have keys under the prefix are read, and directories that are
+// rolled up into a common prefix are only read as far as the first file.
+func (l *fsLister) ListPages(ctx context.Context, q listQuery, fn func(*listPage, bool) bool) error {
+	dir, err := l.bucketDir(q.Bucket)
+	if err != nil {
+		return err
+	}
+	w := &fsWalk{ctx: ctx, q: q, fn: fn, maxKeys: defaultFSPageSize, page: &listPage{}}
+	if q.MaxKeys > 0 {
+		w.maxKeys = int(q.MaxKeys)
+	}
+	err = w.walk(dir, "")
+	if err == errStopWalk {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fn(w.page, true)
+	return nil
+}
+
+// fsWalk is a filesystem listing in progress
+type fsWalk struct {
+	ctx     context.Context
+	q       listQuery
+	fn      func(*listPage, bool) bool
+	maxKeys int
+	page    *listPage
+	// lastPrefix is the last common prefix added. The keys under a common
+	// prefix all come together, so it's only ever added once in a row.
+	lastPrefix string
+}
+
+// walk lists the files in dir, whose keys all start with dirKey. The entries
+// are sorted as keys, with a slash after the names of directories, which
+// puts them in the order S3 would list their keys.
+func (w *fsWalk) walk(dir, dirKey string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) && dirKey != "" {
+		// Removed since its parent was read
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	keys := make([]string, len(entries))
+	for i, fi := range entries {
+		keys[i] = dirKey + fi.Name()
+		if fi.IsDir() {
+			keys[i] = keys[i] + "/"
+		}
+	}
+	sort.Sort(fsEntries{entries, keys})
+
+	for i, fi := range entries {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+		key := keys[i]
+		path := filepath.Join(dir, fi.Name())
+		switch {
+		case fi.IsDir():
+			if !strings.HasPrefix(key, w.q.Prefix) && !strings.HasPrefix(w.q.Prefix, key) {
+				continue
+			}
+			// Every key in the directory is at or before StartAfter unless
+			// StartAfter is in the directory too
+			partial := strings.HasPrefix(w.q.StartAfter, key)
+			if key < w.q.StartAfter && !partial {
+				continue
+			}
+			if cp := w.commonPrefix(key); cp != "" && !partial {
+				if cp == w.lastPrefix {
+					continue
+				}
+				found, err := hasFiles(path)
+				if err != nil {
+					return err
+				}
+				if found {
+					if err := w.add(nil, cp); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := w.walk(path, key); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			if !strings.HasPrefix(key, w.q.Prefix) || key <= w.q.StartAfter {
+				continue
+			}
+			if cp := w.commonPrefix(key); cp != "" {
+				if cp != w.lastPrefix {
+					if err := w.add(nil, cp); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			obj := &objectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}
+			if err := w.add(obj, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commonPrefix returns the common prefix that key rolls up into, if it does
+func (w *fsWalk) commonPrefix(key string) string {
+	if w.q.Delimiter == "" || !strings.HasPrefix(key, w.q.Prefix) {
+		return ""
+	}
+	i := strings.Index(key[len(w.q.Prefix):], w.q.Delimiter)
+	if i < 0 {
+		return ""
+	}
+	return key[:len(w.q.Prefix)+i+len(w.q.Delimiter)]
+}
+
+// add adds an object or a common prefix to the page, handing the page to fn
+// first if it's full
+func (w *fsWalk) add(obj *objectInfo, prefix string) error {
+	if len(w.page.Objects)+len(w.page.CommonPrefixes) >= w.maxKeys {
+		if !w.fn(w.page, false) {
+			return errStopWalk
+		}
+		w.page = &listPage{}
+	}
+	if obj != nil {
+		w.page.Objects = append(w.page.Objects, *obj)
+	} else {
+		w.page.CommonPrefixes = append(w.page.CommonPrefixes, prefix)
+		w.lastPrefix = prefix
+	}
+	return nil
+}
+
+// hasFiles reports whether there are any files in the tree under dir
+func hasFiles(dir string) (bool, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, fi := range entries {
+		if fi.Mode().IsRegular() {
+			return true, nil
+		}
+	}
+	for _, fi := range entries {
+		if fi.IsDir() {
+			found, err := hasFiles(filepath.Join(dir, fi.Name()))
+			if found || err != nil {
+				return found, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// fsEntries sorts the entries in a directory by their keys
+type fsEntries struct {
+	entries []os.FileInfo
+	keys    []string
+}
+
+func (s fsEntries) Len() int           { return len(s.entries) }
+func (s fsEntries) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s fsEntries) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fsKeys are the objects for the filesystem tests. They're chosen so that
+// sorting the files in a directory by name alone would list them in the
+// wrong order.
+var fsKeys = []string{
+	"a!", "a-c", "a.b", "a/b", "a/c/d", "a/c/e", "a/d-e/f", "a0",
+	"b/1/2/3", "b/1/4", "b/2", "c", "z/ß",
+}
+
+// newFSBucket writes fsKeys to a bucket under a new root, along with a
+// few things that aren't objects, and returns the root and the same objects
+// for a memS3Client
+func newFSBucket(t *testing.T) (string, []*s3.Object) {
+	root, err := ioutil.TempDir("", "s3_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC)
+	var objects []*s3.Object
+	for i, key := range fsKeys {
+		path := filepath.Join(root, "bucket", filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		body := fmt.Sprintf("object %d", i)
+		if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modified := base.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(body))),
+			LastModified: aws.Time(modified),
+		})
+	}
+
+	// Empty directories and symbolic links aren't objects
+	for _, dir := range []string{"bucket/empty/dir", "bucket/links"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "outside"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"bucket/links/file": filepath.Join(root, "outside"),
+		"bucket/links/dir":  root,
+		"bucket/linked":     filepath.Join(root, "bucket", "a"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, objects
+}
+
+// TestFSListerParity checks that listing a directory gives the same objects
+// and common prefixes as listing the same keys in S3
+func TestFSListerParity(t *testing.T) {
+	root, objects := newFSBucket(t)
+	defer os.RemoveAll(root)
+	fs := &fsLister{root: root}
+	mem := &s3Lister{svc: newMemS3Client(objects)}
+
+	for _, prefix := range []string{"", "a", "a/", "a/c", "a/c/", "b/", "b/1/", "e", "x"} {
+		for _, delimiter := range []string{"", "/", "-", "c/"} {
+			for _, startAfter := range []string{"", "a-c", "a/b", "a/c/d", "b", "z/ß"} {
+				q := listQuery{Bucket: "bucket", Prefix: prefix, Delimiter: delimiter, StartAfter: startAfter}
+				want, err := listAll(mem, q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := listAll(fs, q)
+				if err != nil {
+					t.Fatalf("%+v: %s", q, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%+v: expected %+v, got %+v", q, want, got)
+				}
+			}
+		}
+	}
+}
+
+// listAll lists everything for a query as a single page
+func listAll(l ObjectLister, q listQuery) (*listPage, error) {
+	all := &listPage{}
+	err := l.ListPages(context.Background(), q, func(page *listPage, lastPage bool) bool {
+		for _, o := range page.Objects {
+			o.LastModified = o.LastModified.UTC()
+			all.Objects = append(all.Objects, o)
+		}
+		all.CommonPrefixes = append(all.CommonPrefixes, page.CommonPrefixes...)
+		return true
+	})
+	return all, err
+}
+
+// TestFSListerPages checks that objects and common prefixes count towards
+// the size of a page, and that listing stops when asked to
+func TestFSListerPages(t *testing.T) {
+	root, _ := newFSBucket(t)
+	defer os.RemoveAll(root)
+	fs := &fsLister{root: root}
+
+	var pages [][]string
+	var last []bool
+	q := listQuery{Bucket: "bucket", Delimiter: "/", MaxKeys: 3}
+	err := fs.ListPages(context.Background(), q, func(page *listPage, lastPage bool) bool {
+		var entries []string
+		for _, o := range page.Objects {
+			entries = append(entries, o.Key)
+		}
+		entries = append(entries, page.CommonPrefixes...)
+		pages = append(pages, entries)
+		last = append(last, lastPage)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"a!", "a-c", "a.b"}, {"a0", "a/", "b/"}, {"c", "z/"}}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Errorf("expected pages %q, got %q", expected, pages)
+	}
+	if !reflect.DeepEqual(last, []bool{false, false, true}) {
+		t.Errorf("unexpected last pages %v", last)
+	}
+
+	calls := 0
+	err = fs.ListPages(context.Background(), q, func(page *listPage, lastPage bool) bool {
+		calls++
+		return false
+	})
+	if err != nil || calls != 1 {
+		t.Errorf("expected listing to stop after a page, got %d pages and %v", calls, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := fs.ListPages(ctx, q, func(*listPage, bool) bool { return true }); err != context.Canceled {
+		t.Errorf("expected the listing to be cancelled, got %v", err)
+	}
+}
+
+// TestFSListerObjects checks reading single objects, and that nothing can
+// be read from outside of the root
+func TestFSListerObjects(t *testing.T) {
+	root, _ := newFSBucket(t)
+	defer os.RemoveAll(root)
+	fs := &fsLister{root: root}
+	ctx := context.Background()
+
+	info, err := fs.Head(ctx, "bucket", "a/c/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "a/c/e" || info.Size != 8 || !info.LastModified.Equal(time.Date(2026, time.October, 1, 5, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected object %+v", info)
+	}
+
+	for byteRange, expected := range map[string]string{
+		"":          "object 5",
+		"bytes=0-3": "obje",
+		"bytes=7-":  "5",
+		"bytes=-3":  "t 5",
+		"bytes=2-9": "ject 5",
+	} {
+		body, err := fs.Get(ctx, "bucket", "a/c/e", byteRange)
+		if err != nil {
+			t.Fatalf("%q: %s", byteRange, err)
+		}
+		b, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Errorf("%q: expected %q, got %q", byteRange, expected, b)
+		}
+	}
+	for _, byteRange := range []string{"bytes=8-", "bytes=3-1", "0-3", "bytes=x-"} {
+		if _, err := fs.Get(ctx, "bucket", "a/c/e", byteRange); err == nil {
+			t.Errorf("%q: expected an error", byteRange)
+		}
+	}
+
+	for _, key := range []string{
+		"missing", "a/c", "a/b/c", "../outside", "a/../a/b", "./a", "a//b", "/a",
+		"links/file", "links/dir/outside", "linked/b", "",
+	} {
+		if _, err := fs.Head(ctx, "bucket", key); !errors.Is(err, errNotFound) {
+			t.Errorf("%q: expected the object not to be found, got %v", key, err)
+		}
+		if _, err := fs.Get(ctx, "bucket", key, ""); !errors.Is(err, errNotFound) {
+			t.Errorf("%q: expected the object not to be found, got %v", key, err)
+		}
+	}
+
+	for _, bucket := range []string{"..", ".", "", "bucket/a", "missing", "outside"} {
+		if _, err := fs.Head(ctx, bucket, "a"); err == nil || errors.Is(err, errNotFound) {
+			t.Errorf("%q: expected an error for the bucket, got %v", bucket, err)
+		}
+		if _, err := listAll(fs, listQuery{Bucket: bucket}); err == nil {
+			t.Errorf("%q: expected an error listing the bucket", bucket)
+		}
+	}
+}
+
+// TestFilesystemModule checks that probing a directory gives the same
+// metrics as probing the same objects in S3
+func TestFilesystemModule(t *testing.T) {
+	root, objects := newFSBucket(t)
+	defer os.RemoveAll(root)
+	svc := newMemS3Client(objects)
+	svc.bodies = map[string][]byte{}
+	for i, key := range fsKeys {
+		svc.bodies[key] = []byte(fmt.Sprintf("object %d", i))
+	}
+
+	conf, err := parseConfig([]byte(fmt.Sprintf(`
+modules:
+  s3_list:
+    max_age: 1h
+  fs_list:
+    max_age: 1h
+    filesystem:
+      root: %[1]q
+  s3_head:
+    prober: head
+  fs_head:
+    prober: head
+    filesystem:
+      root: %[1]q
+  s3_content:
+    prober: content
+    content:
+      range: bytes=0-5
+      assertions:
+        - regex: ^object
+  fs_content:
+    prober: content
+    content:
+      range: bytes=0-5
+      assertions:
+        - regex: ^object
+    filesystem:
+      root: %[1]q
+`, root)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{
+		"bucket=bucket&module=%s_list",
+		"bucket=bucket&module=%s_list&prefix=a/",
+		"bucket=bucket&module=%s_list&prefix=b/&delimiter=/",
+		"bucket=bucket&module=%s_list&delimiter=-",
+		"bucket=bucket&module=%s_head&key=a/d-e/f",
+		"bucket=bucket&module=%s_head&key=links/file",
+		"bucket=bucket&module=%s_content&key=z/ß",
+	} {
+		outputs := map[string][]byte{}
+		for _, backend := range []string{"s3", "fs"} {
+			req, err := http.NewRequest("GET", "/probe?"+fmt.Sprintf(query, backend), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			probeHandler(rr, req, svc, conf, nil, 0)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s: expected a 200, got %d: %s", req.URL, rr.Code, rr.Body.String())
+			}
+			outputs[backend], err = normalizeExposition(rr.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(outputs["fs"], outputs["s3"]) {
+			t.Errorf("%s: expected the same metrics as S3:\n%s\ngot:\n%s", query, outputs["s3"], outputs["fs"])
+		}
+	}
+}
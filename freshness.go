@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Expectations are thresholds that the objects under a prefix should meet.
+// They can be set on a module and overridden for each target with the
+// parameters of the same name.
+type Expectations struct {
+	// MaxAge is how long ago the most recently modified object can have
+	// been modified
+	MaxAge model.Duration `yaml:"max_age,omitempty"`
+	// MinObjects is the fewest objects there should be
+	MinObjects int64 `yaml:"min_objects,omitempty"`
+	// MinSize is the smallest the objects should add up to, in bytes
+	MinSize int64 `yaml:"min_size,omitempty"`
+}
+
+// set reports whether there's anything to check
+func (x Expectations) set() bool {
+	return x.MaxAge > 0 || x.MinObjects > 0 || x.MinSize > 0
+}
+
+// met reports whether result meets the expectations at the time now
+func (x Expectations) met(result *listResult, now time.Time) bool {
+	if x.MaxAge > 0 && (result.objects == 0 || now.Sub(result.lastModified) > time.Duration(x.MaxAge)) {
+		return false
+	}
+	if result.objects < x.MinObjects {
+		return false
+	}
+	if result.totalSize < x.MinSize {
+		return false
+	}
+	return true
+}
+
+// withParams returns the expectations with any that are set in the query
+// parameters replaced
+func (x Expectations) withParams(params url.Values) (Expectations, error) {
+	if v := params.Get("max_age"); v != "" {
+		d, err := model.ParseDuration(v)
+		if err != nil {
+			return x, fmt.Errorf("invalid max_age parameter: %s", err)
+		}
+		x.MaxAge = d
+	}
+	if v := params.Get("min_objects"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return x, fmt.Errorf("invalid min_objects parameter %q", v)
+		}
+		x.MinObjects = n
+	}
+	if v := params.Get("min_size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return x, fmt.Errorf("invalid min_size parameter %q", v)
+		}
+		x.MinSize = n
+	}
+	return x, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// TestExpectationsMet checks each of the thresholds
+func TestExpectationsMet(t *testing.T) {
+	now := time.Date(2020, time.January, 2, 0, 0, 0, 0, time.UTC)
+	result := &listResult{
+		objects:      10,
+		totalSize:    1000,
+		lastModified: now.Add(-2 * time.Hour),
+	}
+
+	tests := []struct {
+		expect Expectations
+		met    bool
+	}{
+		{Expectations{MaxAge: model.Duration(3 * time.Hour)}, true},
+		{Expectations{MaxAge: model.Duration(1 * time.Hour)}, false},
+		{Expectations{MinObjects: 10}, true},
+		{Expectations{MinObjects: 11}, false},
+		{Expectations{MinSize: 1000}, true},
+		{Expectations{MinSize: 1001}, false},
+		{Expectations{MaxAge: model.Duration(3 * time.Hour), MinObjects: 5, MinSize: 1001}, false},
+	}
+	for _, tc := range tests {
+		if met := tc.expect.met(result, now); met != tc.met {
+			t.Errorf("%+v: expected met to be %t", tc.expect, tc.met)
+		}
+	}
+
+	if (Expectations{MaxAge: model.Duration(time.Hour)}).met(&listResult{}, now) {
+		t.Errorf("expected max_age not to be met when there are no objects")
+	}
+}
+
+// TestProbeHandlerExpectations checks expectations from the module and the
+// query parameters end up in the probe's metrics
+func TestProbeHandlerExpectations(t *testing.T) {
+	conf, err := parseConfig([]byte(`
+modules:
+  daily:
+    max_age: 1d
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{
+			query: "bucket=mock&prefix=one&module=daily",
+			expected: []string{
+				`s3_freshness_ok{bucket="mock",prefix="one"} 0`,
+				`s3_expected_max_age_seconds{bucket="mock",prefix="one"} 86400`,
+			},
+		},
+		{
+			query: "bucket=mock&prefix=one&max_age=100y",
+			expected: []string{
+				`s3_freshness_ok{bucket="mock",prefix="one"} 1`,
+				`s3_expected_max_age_seconds{bucket="mock",prefix="one"} 3.1536e+09`,
+			},
+		},
+		{
+			query: "bucket=mock&prefix=multiple&min_objects=5",
+			expected: []string{
+				`s3_freshness_ok{bucket="mock",prefix="multiple"} 0`,
+			},
+		},
+		{
+			query: "bucket=mock&prefix=does-not-exist&min_objects=1",
+			expected: []string{
+				`s3_freshness_ok{bucket="mock",prefix="does-not-exist"} 0`,
+			},
+		},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", "/probe?"+tc.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, mockSvc, conf, nil, 0)
+
+		for _, l := range tc.expected {
+			if !strings.Contains(rr.Body.String(), l) {
+				t.Errorf("%s: expected %s", tc.query, l)
+			}
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/probe?bucket=mock&prefix=one&max_age=soon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, mockSvc, conf, nil, 0)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid max_age to be a bad request, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+// goldenConfig has a module for each kind of probe in the golden tests. It's
+// formatted with the root of the filesystem modules and the URL of the fake
+// CloudWatch.
+const goldenConfig = `
+modules:
+  budget:
+    max_objects: 4
+  expect:
+    max_age: 1h
+    min_objects: 10
+    min_size: 1000
+  inventory:
+    prober: inventory
+    inventory:
+      bucket: inventory-bucket
+      prefix: inventory
+      config_id: daily
+  head:
+    prober: head
+    max_age: 1h
+    head:
+      metadata: [backup-id]
+  content:
+    prober: content
+    content:
+      assertions:
+        - regex: '"status":"ok"'
+        - name: count
+          jmespath: count
+          equals: "3"
+  json:
+    prober: json
+    json:
+      metrics:
+        - name: job_records
+          help: Records processed by the job
+          path: records
+        - name: job_table_rows
+          each: tables
+          path: rows
+          labels:
+            table: name
+  textfile:
+    prober: textfile
+  compare:
+    prober: compare
+  cloudwatch:
+    prober: cloudwatch
+    cloudwatch:
+      endpoint_url: %[2]s
+  cloudwatch_storage_types:
+    prober: cloudwatch
+    cloudwatch:
+      endpoint_url: %[2]s
+      storage_types: [StandardStorage]
+  accesslog:
+    prober: accesslog
+    access_log:
+      lookback: 100y
+  accesslog_requesters:
+    prober: accesslog
+    access_log:
+      lookback: 100y
+      max_requesters: 1
+  accesslog_truncated:
+    prober: accesslog
+    max_objects: 1
+    access_log:
+      lookback: 100y
+  cloudtrail:
+    prober: cloudtrail
+    cloudtrail:
+      buckets: [data, logs]
+      lookback: 100y
+  cloudtrail_principals:
+    prober: cloudtrail
+    cloudtrail:
+      buckets: [data, logs]
+      lookback: 100y
+      max_principals: 1
+  cloudtrail_truncated:
+    prober: cloudtrail
+    max_objects: 2
+    cloudtrail:
+      buckets: [data, logs]
+      lookback: 100y
+  incremental:
+    incremental: {}
+  state:
+    state:
+      bucket: state
+      prefix: s3_exporter/
+  filesystem:
+    filesystem:
+      root: %[1]q
+  filesystem_head:
+    prober: head
+    filesystem:
+      root: %[1]q
+`
+
+// goldenS3Client has the objects for every golden test that doesn't need
+// its own client
+func goldenS3Client() *memS3Client {
+	objects := memObjects()
+	modified := time.Date(2026, time.October, 16, 12, 0, 0, 0, time.UTC)
+	bodies := map[string][]byte{
+		"status/health.json": []byte(`{"status":"ok","count":3}`),
+		"status/job.json":    []byte(`{"records":1234,"tables":[{"name":"users","rows":100},{"name":"orders","rows":2000}]}`),
+		"metrics/a.prom":     []byte("# HELP job_success If the job succeeded.\n# TYPE job_success gauge\njob_success{job=\"a\"} 1\n"),
+		"metrics/b.prom":     []byte("# TYPE job_success gauge\njob_success{job=\"b\"} 0\n"),
+		"metrics/bad.prom":   []byte("job_success{job=\"c\" 1\n"),
+		"metrics/own.prom":   []byte("s3_list_success 1\n"),
+	}
+	for key, body := range bodies {
+		objects = append(objects, &s3.Object{
+			Key:          aws.String(key),
+			LastModified: aws.Time(modified),
+			Size:         aws.Int64(int64(len(body))),
+		})
+	}
+	svc := newMemS3Client(objects)
+	svc.bodies = bodies
+	svc.metadata = map[string]map[string]*string{
+		"data/b": {"Backup-Id": aws.String("1234")},
+	}
+	svc.errs = map[string]error{
+		"forbidden": awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, ""),
+	}
+	return svc
+}
+
+// goldenAccessLogs has access logs under logs/ from requests to the data
+// bucket, with a line that can't be parsed
+func goldenAccessLogs() *memS3Client {
+	alice := "arn:aws:iam::123456789012:user/alice"
+	bob := "arn:aws:iam::123456789012:user/bob"
+	base := time.Date(2026, time.October, 16, 12, 0, 0, 0, time.UTC)
+	return newAccessLogBucket(map[time.Time]string{
+		base: accessLogLine(alice, "REST.GET.OBJECT", 200, "100") +
+			accessLogLine(alice, "REST.GET.OBJECT", 200, "50"),
+		base.Add(time.Hour): accessLogLine(bob, "REST.PUT.OBJECT", 403, "-") +
+			"garbage\n" +
+			accessLogLine(bob, "REST.GET.OBJECT", 200, "10") +
+			accessLogLine("-", "REST.GET.OBJECT", 404, "300"),
+	})
+}
+
+// TestGolden compares the whole of the output of a probe with the file of
+// the same name in testdata/golden. Run the tests with -update to write the
+// files after changing what a probe exposes, and check the difference.
+func TestGolden(t *testing.T) {
+	memoryState = newMemStateStore(defaultMemoryStateTargets)
+	root, _ := newFSBucket(t)
+	defer os.RemoveAll(root)
+	day := time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC)
+	cw := newFakeCloudWatch(map[string][]cloudWatchDatapoint{
+		"mock/NumberOfObjects/AllStorageTypes":  {{day.Add(-24 * time.Hour), 40}, {day, 42}},
+		"mock/BucketSizeBytes/StandardStorage":  {{day, 1024}, {day.Add(-24 * time.Hour), 1000}},
+		"mock/BucketSizeBytes/GlacierStorage":   {{day.Add(-24 * time.Hour), 2048}},
+		"empty/BucketSizeBytes/StandardStorage": nil,
+	})
+	defer cw.Close()
+	conf, err := parseConfig([]byte(fmt.Sprintf(goldenConfig, root, cw.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := session.Must(session.NewSession(aws.NewConfig().
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithRegion("us-east-1").
+		WithMaxRetries(0),
+	))
+	conf.setupClients(sess, S3Config{}, nil)
+
+	tests := []struct {
+		name    string
+		query   string
+		timeout string
+		svc     func(t *testing.T) s3iface.S3API
+	}{
+		{name: "list", query: "bucket=mock&prefix=data/"},
+		{name: "list_delimiter", query: "bucket=mock&prefix=data/&delimiter=/"},
+		{name: "list_template", query: `bucket=mock&prefix={{ print "data/" }}`},
+		{name: "list_truncated", query: "bucket=mock&prefix=data/&module=budget"},
+		{name: "list_expectations", query: "bucket=mock&prefix=data/&module=expect"},
+		{name: "list_error", query: "bucket=mock&prefix=nope&module=expect", svc: func(t *testing.T) s3iface.S3API { return mockSvc }},
+		{name: "list_timeout", query: "bucket=mock&prefix=hang", timeout: "0.05", svc: func(t *testing.T) s3iface.S3API { return mockSvc }},
+		{
+			name:  "inventory",
+			query: "bucket=source-bucket&prefix=logs/&module=inventory",
+			svc:   func(t *testing.T) s3iface.S3API { return newMemS3ClientFromDir(t, "testdata/inventory") },
+		},
+		{
+			name:  "inventory_error",
+			query: "bucket=missing-bucket&module=inventory",
+			svc:   func(t *testing.T) s3iface.S3API { return newMemS3ClientFromDir(t, "testdata/inventory") },
+		},
+		{name: "head", query: "bucket=mock&module=head&key=data/b"},
+		{name: "head_missing", query: "bucket=mock&module=head&key=data/missing"},
+		{name: "head_error", query: "bucket=mock&module=head&key=forbidden"},
+		{name: "content", query: "bucket=mock&module=content&key=status/health.json"},
+		{name: "content_mismatch", query: "bucket=mock&module=content&key=status/job.json"},
+		{name: "content_error", query: "bucket=mock&module=content&key=forbidden"},
+		{name: "json", query: "bucket=mock&module=json&key=status/job.json"},
+		{name: "json_error", query: "bucket=mock&module=json&key=forbidden"},
+		{name: "textfile", query: "bucket=mock&module=textfile&prefix=metrics/"},
+		{name: "compare", query: "bucket=mock&module=compare&prefix=data/0a/&destination_prefix=data/a0/"},
+		{name: "cloudwatch", query: "bucket=mock&module=cloudwatch"},
+		{name: "cloudwatch_storage_types", query: "bucket=mock&module=cloudwatch_storage_types"},
+		{name: "cloudwatch_empty", query: "bucket=empty&module=cloudwatch"},
+		{name: "cloudwatch_error", query: "bucket=broken&module=cloudwatch_storage_types"},
+		{name: "accesslog", query: "bucket=logs&prefix=logs/&module=accesslog", svc: func(t *testing.T) s3iface.S3API { return goldenAccessLogs() }},
+		{name: "accesslog_requesters", query: "bucket=logs&prefix=logs/&module=accesslog_requesters", svc: func(t *testing.T) s3iface.S3API { return goldenAccessLogs() }},
+		{name: "accesslog_truncated", query: "bucket=logs&prefix=logs/&module=accesslog_truncated", svc: func(t *testing.T) s3iface.S3API { return goldenAccessLogs() }},
+		{name: "accesslog_error", query: "bucket=mock&prefix=nope&module=accesslog", svc: func(t *testing.T) s3iface.S3API { return mockSvc }},
+		{
+			name:  "cloudtrail",
+			query: "bucket=trail&prefix=AWSLogs/123456789012/CloudTrail/eu-west-1/&module=cloudtrail",
+			svc:   func(t *testing.T) s3iface.S3API { return newCloudTrailBucket(t) },
+		},
+		{
+			name:  "cloudtrail_principals",
+			query: "bucket=trail&prefix=AWSLogs/123456789012/CloudTrail/eu-west-1/&module=cloudtrail_principals",
+			svc:   func(t *testing.T) s3iface.S3API { return newCloudTrailBucket(t) },
+		},
+		{
+			name:  "cloudtrail_truncated",
+			query: "bucket=trail&prefix=AWSLogs/123456789012/CloudTrail/eu-west-1/&module=cloudtrail_truncated",
+			svc:   func(t *testing.T) s3iface.S3API { return newCloudTrailBucket(t) },
+		},
+		{name: "cloudtrail_error", query: "bucket=mock&prefix=nope&module=cloudtrail", svc: func(t *testing.T) s3iface.S3API { return mockSvc }},
+		{name: "incremental", query: "bucket=mock&prefix=data/&module=incremental"},
+		{name: "state", query: "bucket=mock&prefix=data/&module=state"},
+		{name: "filesystem", query: "bucket=bucket&module=filesystem&prefix=a/"},
+		{name: "filesystem_head", query: "bucket=bucket&module=filesystem_head&key=a/c/e"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var svc s3iface.S3API = goldenS3Client()
+			if tc.svc != nil {
+				svc = tc.svc(t)
+			}
+			req, err := http.NewRequest("GET", "/probe?"+tc.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.timeout != "" {
+				req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tc.timeout)
+			}
+			rr := httptest.NewRecorder()
+			probeHandler(rr, req, svc, conf, nil, 0)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected a 200, got %d: %s", rr.Code, rr.Body.String())
+			}
+
+			got, err := normalizeExposition(rr.Body.Bytes())
+			if err != nil {
+				t.Fatalf("error parsing the output: %s\n%s", err, rr.Body.String())
+			}
+
+			path := filepath.Join("testdata", "golden", tc.name+".prom")
+			if *update {
+				if err := ioutil.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output doesn't match %s, got:\n%s", path, got)
+			}
+		})
+	}
+}
+
+// normalizeExposition parses metrics in the text format and writes them back
+// out in name order, with the durations, ages and dates of the probe itself
+// zeroed so that they can be compared
+func normalizeExposition(b []byte) ([]byte, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out bytes.Buffer
+	for _, name := range names {
+		mf := families[name]
+		if strings.HasSuffix(name, "_duration_seconds") || name == "s3_compare_newest_unsynced_age_seconds" || name == "s3_last_full_list_date" {
+			for _, m := range mf.Metric {
+				if m.Gauge != nil {
+					m.Gauge.Value = aws.Float64(0)
+				}
+			}
+		}
+		if _, err := expfmt.MetricFamilyToText(&out, mf); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	s3HeadSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "head_success"),
+		"If the HeadObject operation was a success, which includes finding that the object doesn't exist",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3HeadDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "head_duration_seconds"),
+		"The duration of the HeadObject operation",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3ObjectExists = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "object_exists"),
+		"If the object exists",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3ObjectSize = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "object_size_bytes"),
+		"The size of the object",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3ObjectLastModified = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "object_last_modified"),
+		"The last modified date of the object",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3ObjectMetadata = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "object_metadata_info"),
+		"The value of a piece of user metadata on the object",
+		[]string{"bucket", "key", "name", "value"}, nil,
+	)
+	s3ResolvedKey = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "resolved_key_info"),
+		"The key that was checked, after evaluating the template in the key parameter",
+		[]string{"bucket", "key", "resolved_key"}, nil,
+	)
+	s3ObjectFreshnessOK = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "object", "freshness_ok"),
+		"If the object meets the max_age and min_size expected of it",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3ObjectExpectedMaxAge = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "object", "expected_max_age_seconds"),
+		"How long ago the object is expected to have been modified, at most",
+		[]string{"bucket", "key"}, nil,
+	)
+)
+
+// HeadConfig configures the head prober
+type HeadConfig struct {
+	// Metadata lists the user metadata to expose, without the x-amz-meta-
+	// prefix
+	Metadata []string `yaml:"metadata,omitempty"`
+}
+
+func (e *Exporter) describeHead(ch chan<- *prometheus.Desc) {
+	ch <- s3HeadSuccess
+	ch <- s3HeadDuration
+	ch <- s3ObjectExists
+	ch <- s3ObjectSize
+	ch <- s3ObjectLastModified
+	ch <- s3ObjectMetadata
+	if e.key != e.keyLabel {
+		ch <- s3ResolvedKey
+	}
+	if e.expect.set() {
+		ch <- s3ObjectFreshnessOK
+	}
+	if e.expect.MaxAge > 0 {
+		ch <- s3ObjectExpectedMaxAge
+	}
+}
+
+// collectHead checks a single object with HeadObject rather than listing
+func (e *Exporter) collectHead(ch chan<- prometheus.Metric) {
+	if e.key != e.keyLabel {
+		ch <- prometheus.MustNewConstMetric(
+			s3ResolvedKey, prometheus.GaugeValue, 1, e.bucket, e.keyLabel, e.key,
+		)
+	}
+
+	start := time.Now()
+	info, err := e.lister.Head(e.ctx, e.bucket, e.key)
+	duration := time.Since(start).Seconds()
+	notFound := errors.Is(err, errNotFound)
+	observeProbe(e.moduleName, start, err == nil || notFound)
+
+	if err != nil && !notFound {
+		log.Errorln(err)
+		ch <- prometheus.MustNewConstMetric(
+			s3HeadSuccess, prometheus.GaugeValue, 0, e.bucket, e.keyLabel,
+		)
+		e.collectObjectExpectations(ch, nil)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		s3HeadSuccess, prometheus.GaugeValue, 1, e.bucket, e.keyLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3HeadDuration, prometheus.GaugeValue, duration, e.bucket, e.keyLabel,
+	)
+	if notFound {
+		ch <- prometheus.MustNewConstMetric(
+			s3ObjectExists, prometheus.GaugeValue, 0, e.bucket, e.keyLabel,
+		)
+		e.collectObjectExpectations(ch, &listResult{})
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		s3ObjectExists, prometheus.GaugeValue, 1, e.bucket, e.keyLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3ObjectSize, prometheus.GaugeValue, float64(info.Size), e.bucket, e.keyLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3ObjectLastModified, prometheus.GaugeValue, float64(info.LastModified.Unix()), e.bucket, e.keyLabel,
+	)
+	if e.module.Head != nil {
+		for _, name := range e.module.Head.Metadata {
+			for k, v := range info.Metadata {
+				if strings.EqualFold(k, name) {
+					ch <- prometheus.MustNewConstMetric(
+						s3ObjectMetadata, prometheus.GaugeValue, 1, e.bucket, e.keyLabel, name, v,
+					)
+				}
+			}
+		}
+	}
+
+	result := &listResult{}
+	result.add(info)
+	e.collectObjectExpectations(ch, result)
+}
+
+// collectObjectExpectations reports whether the object met the expectations
+// set for the probe. A failed request, with a nil result, never does.
+func (e *Exporter) collectObjectExpectations(ch chan<- prometheus.Metric, result *listResult) {
+	if !e.expect.set() {
+		return
+	}
+	ok := 0.0
+	if result != nil && e.expect.met(result, time.Now()) {
+		ok = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		s3ObjectFreshnessOK, prometheus.GaugeValue, ok, e.bucket, e.keyLabel,
+	)
+	if e.expect.MaxAge > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			s3ObjectExpectedMaxAge, prometheus.GaugeValue, time.Duration(e.expect.MaxAge).Seconds(), e.bucket, e.keyLabel,
+		)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// TestProbeHandlerHead checks the metrics for objects that exist, don't
+// exist and can't be checked
+func TestProbeHandlerHead(t *testing.T) {
+	svc := newMemS3Client(memObjects())
+	svc.metadata = map[string]map[string]*string{
+		"data/b": {"Backup-Id": aws.String("1234"), "Other": aws.String("ignored")},
+	}
+	svc.errs = map[string]error{
+		"forbidden": awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), 403, ""),
+	}
+	conf, err := parseConfig([]byte(`
+modules:
+  head:
+    prober: head
+    min_size: 100
+    head:
+      metadata: [backup-id]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	tests := []struct {
+		key      string
+		expected []string
+		missing  []string
+	}{
+		{
+			key: "data/b",
+			expected: []string{
+				`s3_head_success{bucket="mock",key="data/b"} 1`,
+				`s3_object_exists{bucket="mock",key="data/b"} 1`,
+				`s3_object_size_bytes{bucket="mock",key="data/b"} 107`,
+				`s3_object_last_modified{bucket="mock",key="data/b"} 1.577844e+09`,
+				`s3_object_metadata_info{bucket="mock",key="data/b",name="backup-id",value="1234"} 1`,
+				`s3_object_freshness_ok{bucket="mock",key="data/b"} 1`,
+			},
+			missing: []string{`name="Other"`, `name="other"`},
+		},
+		{
+			key: `data/{{ .Now.Format "2006-01-02" }}.dump`,
+			expected: []string{
+				`s3_head_success{bucket="mock",key="data/{{ .Now.Format \"2006-01-02\" }}.dump"} 1`,
+				`s3_object_exists{bucket="mock",key="data/{{ .Now.Format \"2006-01-02\" }}.dump"} 0`,
+				`s3_resolved_key_info{bucket="mock",key="data/{{ .Now.Format \"2006-01-02\" }}.dump",resolved_key="data/` + today + `.dump"} 1`,
+				`s3_object_freshness_ok{bucket="mock",key="data/{{ .Now.Format \"2006-01-02\" }}.dump"} 0`,
+			},
+		},
+		{
+			key: "forbidden",
+			expected: []string{
+				`s3_head_success{bucket="mock",key="forbidden"} 0`,
+			},
+			missing: []string{"s3_object_exists"},
+		},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", "/probe?bucket=mock&module=head&key="+url.QueryEscape(tc.key), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, svc, conf, nil, 0)
+
+		for _, l := range tc.expected {
+			if !strings.Contains(rr.Body.String(), l) {
+				t.Errorf("%s: expected %s", tc.key, l)
+			}
+		}
+		for _, l := range tc.missing {
+			if strings.Contains(rr.Body.String(), l) {
+				t.Errorf("%s: didn't expect %s", tc.key, l)
+			}
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/probe?bucket=mock&module=head", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, svc, conf, nil, 0)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a missing key to be a bad request, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	s3ListIncremental = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "list", "incremental"),
+		"If the probe only listed the keys after the last one seen, rather than the whole prefix",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3LastFullListDate = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_full_list_date"),
+		"When the whole prefix was last listed, which the totals of incremental probes are based on",
+		[]string{"bucket", "prefix"}, nil,
+	)
+)
+
+// IncrementalConfig has probes list only the keys after the last one seen
+// by the probe before and add them to the totals so far. It suits prefixes
+// that objects are only ever added to, with keys in the order they're
+// added, like logs with timestamps in their keys.
+type IncrementalConfig struct {
+	// FullRelistEvery is how often the whole prefix is listed again, to
+	// catch up with objects that have been deleted
+	FullRelistEvery model.Duration `yaml:"full_relist_every,omitempty"`
+}
+
+// UnmarshalYAML sets the defaults for an incremental config and validates it
+func (i *IncrementalConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain IncrementalConfig
+	*i = IncrementalConfig{FullRelistEvery: model.Duration(24 * time.Hour)}
+	if err := value.Decode((*plain)(i)); err != nil {
+		return err
+	}
+	if i.FullRelistEvery <= 0 {
+		return fmt.Errorf("line %d: full_relist_every must be more than 0", value.Line)
+	}
+	return nil
+}
+
+// memStateStore keeps state in memory, for when a module has nowhere else to
+// keep it. It's lost when the exporter restarts. Only the state of the
+// targets probed most recently is kept, so that probes of any number of
+// targets can't use up all the memory.
+type memStateStore struct {
+	sync.Mutex
+	// max is the most targets kept, 0 for no limit
+	max int
+	// used has the state of each target, most recently used first
+	used *list.List
+	m    map[string]*list.Element
+}
+
+// memState is the state of a target in a memStateStore
+type memState struct {
+	id string
+	b  []byte
+}
+
+// defaultMemoryStateTargets is how many targets memoryState keeps by default
+const defaultMemoryStateTargets = 1000
+
+var memoryState = newMemStateStore(defaultMemoryStateTargets)
+
+func newMemStateStore(max int) *memStateStore {
+	return &memStateStore{max: max, used: list.New(), m: map[string]*list.Element{}}
+}
+
+// totalsStore is where probes that add to the totals of the probe before
+// keep them: in the module's state if it has one, or in memory
+func (e *Exporter) totalsStore() stateStore {
+	if e.state != nil {
+		return e.state
+	}
+	return memoryState
+}
+
+func (s *memStateStore) load(ctx context.Context, id string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.m[id]
+	if !ok {
+		return nil, nil
+	}
+	s.used.MoveToFront(el)
+	return el.Value.(*memState).b, nil
+}
+
+// save drops the state of the target used longest ago when there are more
+// than max
+func (s *memStateStore) save(ctx context.Context, id string, b []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if el, ok := s.m[id]; ok {
+		el.Value.(*memState).b = b
+		s.used.MoveToFront(el)
+		return nil
+	}
+	s.m[id] = s.used.PushFront(&memState{id: id, b: b})
+	if s.max > 0 && s.used.Len() > s.max {
+		oldest := s.used.Back()
+		s.used.Remove(oldest)
+		delete(s.m, oldest.Value.(*memState).id)
+	}
+	return nil
+}
+
+// incrementalState is the totals of the listing so far
+type incrementalState struct {
+	ResolvedPrefix string    `json:"resolved_prefix"`
+	FullList       time.Time `json:"full_list"`
+	// LastKey is the key that the next probe lists after
+	LastKey          string                       `json:"last_key"`
+	Objects          int64                        `json:"objects"`
+	TotalSize        int64                        `json:"total_size"`
+	BiggestSize      int64                        `json:"biggest_size"`
+	LastModified     time.Time                    `json:"last_modified"`
+	LastModifiedKey  string                       `json:"last_modified_key"`
+	LastObjectSize   int64                        `json:"last_object_size"`
+	FirstModified    time.Time                    `json:"first_modified"`
+	FirstModifiedKey string                       `json:"first_modified_key"`
+	FirstObjectSize  int64                        `json:"first_object_size"`
+	StorageClasses   map[string]storageClassState `json:"storage_classes,omitempty"`
+	// Digests are only kept for modules that count the objects added and
+	// removed
+	Digests []byte `json:"digests,omitempty"`
+}
+
+// storageClassState is a storageClassTotal in the state
+type storageClassState struct {
+	Objects   int64 `json:"objects"`
+	TotalSize int64 `json:"total_size"`
+}
+
+// result turns the totals back into a listResult
+func (s *incrementalState) result(keepDigests bool) *listResult {
+	r := &listResult{
+		objects:          s.Objects,
+		totalSize:        s.TotalSize,
+		biggestSize:      s.BiggestSize,
+		lastModified:     s.LastModified,
+		lastModifiedKey:  s.LastModifiedKey,
+		lastObjectSize:   s.LastObjectSize,
+		firstModified:    s.FirstModified,
+		firstModifiedKey: s.FirstModifiedKey,
+		firstObjectSize:  s.FirstObjectSize,
+		lastKey:          s.LastKey,
+		keepDigests:      keepDigests,
+	}
+	for class, t := range s.StorageClasses {
+		r.addStorageClass(class, t.Objects, t.TotalSize)
+	}
+	if keepDigests {
+		r.digests = decodeDigests(s.Digests)
+	}
+	return r
+}
+
+// newIncrementalState records the totals in r
+func newIncrementalState(r *listResult) *incrementalState {
+	s := &incrementalState{
+		LastKey:          r.lastKey,
+		Objects:          r.objects,
+		TotalSize:        r.totalSize,
+		BiggestSize:      r.biggestSize,
+		LastModified:     r.lastModified,
+		LastModifiedKey:  r.lastModifiedKey,
+		LastObjectSize:   r.lastObjectSize,
+		FirstModified:    r.firstModified,
+		FirstModifiedKey: r.firstModifiedKey,
+		FirstObjectSize:  r.firstObjectSize,
+	}
+	for class, t := range r.storageClasses {
+		if s.StorageClasses == nil {
+			s.StorageClasses = map[string]storageClassState{}
+		}
+		s.StorageClasses[class] = storageClassState{Objects: t.objects, TotalSize: t.totalSize}
+	}
+	if r.keepDigests {
+		s.Digests = encodeDigests(r.digests)
+	}
+	return s
+}
+
+// listIncremental lists the keys after the last one seen by the probe
+// before, and adds them to the totals so far. The whole prefix is listed
+// when there are no totals, the prefix has changed or it's time for a full
+// relist. A listing that runs out of budget is saved as far as it got, so
+// the next probe carries on from there.
+func (e *Exporter) listIncremental(b *listBudget) (*listResult, error) {
+	store := e.totalsStore()
+	id := e.stateID() + "-incremental"
+	defer lockState(id)()
+
+	var prev *incrementalState
+	data, err := store.load(e.ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("error loading incremental state: %s", err)
+	}
+	if data != nil {
+		prev = &incrementalState{}
+		if err := json.Unmarshal(data, prev); err != nil {
+			return nil, fmt.Errorf("error decoding incremental state: %s", err)
+		}
+		if prev.ResolvedPrefix != e.prefix ||
+			time.Since(prev.FullList) >= time.Duration(e.module.Incremental.FullRelistEvery) {
+			prev = nil
+		}
+	}
+
+	query := listQuery{Bucket: e.bucket, Prefix: e.prefix}
+	result := e.newListResult()
+	fullList := time.Now()
+	if prev != nil {
+		query.StartAfter = prev.LastKey
+		result = prev.result(result.keepDigests)
+		result.incremental = true
+		fullList = prev.FullList
+	}
+	err = e.listPages(e.ctx, query, b, result, func(page *listPage) bool {
+		return addObjects(page, b, result, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.lastFullList = fullList
+
+	next := newIncrementalState(result)
+	next.ResolvedPrefix = e.prefix
+	next.FullList = fullList
+	data, err = json.Marshal(next)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.save(e.ctx, id, data); err != nil {
+		return nil, fmt.Errorf("error saving incremental state: %s", err)
+	}
+	return result, nil
+}
+
+// collectIncremental reports how the totals were worked out
+func (e *Exporter) collectIncremental(ch chan<- prometheus.Metric, result *listResult) {
+	ch <- prometheus.MustNewConstMetric(
+		s3ListIncremental, prometheus.GaugeValue, boolToFloat(result.incremental), e.bucket, e.prefixLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3LastFullListDate, prometheus.GaugeValue, float64(result.lastFullList.Unix()), e.bucket, e.prefixLabel,
+	)
+}
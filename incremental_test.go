@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// TestProbeHandlerIncremental checks that incremental probes add new keys to
+// the totals, catch up after running out of budget and correct the totals
+// on a full relist
+func TestProbeHandlerIncremental(t *testing.T) {
+	conf, err := parseConfig([]byte(`
+modules:
+  incremental:
+    incremental:
+      full_relist_every: 1h
+  budget:
+    max_objects: 2
+    incremental: {}
+  relist:
+    incremental:
+      full_relist_every: 1ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC)
+	logs := func(hours ...int) []*s3.Object {
+		var objects []*s3.Object
+		for _, h := range hours {
+			modified := base.Add(time.Duration(h) * time.Hour)
+			objects = append(objects, &s3.Object{
+				Key:          aws.String("logs/" + modified.Format("2006-01-02T15")),
+				Size:         aws.Int64(int64(100 + h)),
+				LastModified: aws.Time(modified),
+			})
+		}
+		return objects
+	}
+	labels := `{bucket="mock",prefix="logs/"}`
+	truncatedLabels := `{bucket="mock",delimiter="",prefix="logs/"}`
+	type step struct {
+		objects  []*s3.Object
+		expected []string
+	}
+	// What the first probe of a prefix reports is in the incremental golden
+	// test
+	tests := map[string][]step{
+		// The deleted object is still counted until the next full relist
+		"incremental": {
+			{
+				objects: logs(0, 1, 2),
+			},
+			{
+				objects: logs(1, 2, 3),
+				expected: []string{
+					"s3_list_incremental" + labels + " 1",
+					"s3_objects" + labels + " 4",
+					"s3_objects_size_sum_bytes" + labels + " 406",
+					"s3_last_modified_object_date" + labels + " 1.7908236e+09",
+					"s3_last_full_list_date" + labels,
+				},
+			},
+		},
+		"budget": {
+			{
+				objects: logs(0, 1, 2, 3, 4),
+				expected: []string{
+					"s3_list_incremental" + labels + " 0",
+					"s3_objects" + labels + " 2",
+					"s3_list_truncated" + truncatedLabels + " 1",
+				},
+			},
+			{
+				objects: logs(0, 1, 2, 3, 4),
+				expected: []string{
+					"s3_list_incremental" + labels + " 1",
+					"s3_objects" + labels + " 4",
+					"s3_list_truncated" + truncatedLabels + " 1",
+				},
+			},
+			{
+				objects: logs(0, 1, 2, 3, 4),
+				expected: []string{
+					"s3_objects" + labels + " 5",
+					"s3_list_truncated" + truncatedLabels + " 0",
+				},
+			},
+		},
+		"relist": {
+			{
+				objects:  logs(0, 1, 2),
+				expected: []string{"s3_objects" + labels + " 3"},
+			},
+			{
+				objects: logs(1, 2),
+				expected: []string{
+					"s3_list_incremental" + labels + " 0",
+					"s3_objects" + labels + " 2",
+				},
+			},
+		},
+	}
+	for module, steps := range tests {
+		svc := newMemS3Client(nil)
+		for i, step := range steps {
+			svc.objects = newMemS3Client(step.objects).objects
+			// Leave time for the relist module to be due a full relist
+			time.Sleep(2 * time.Millisecond)
+			req, err := http.NewRequest("GET", "/probe?bucket=mock&prefix=logs/&module="+module, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			probeHandler(rr, req, svc, conf, nil, 0)
+
+			for _, l := range step.expected {
+				if !strings.Contains(rr.Body.String(), l) {
+					t.Errorf("%s, probe %d: expected %s in:\n%s", module, i, l, rr.Body.String())
+				}
+			}
+		}
+	}
+}
+
+// TestMemStateStore checks that only the targets used most recently are
+// kept in memory
+func TestMemStateStore(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStateStore(2)
+	s.save(ctx, "a", []byte("1"))
+	s.save(ctx, "b", []byte("2"))
+	s.load(ctx, "a")
+	s.save(ctx, "c", []byte("3"))
+
+	for id, expected := range map[string]string{"a": "1", "b": "", "c": "3"} {
+		b, err := s.load(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Errorf("%s: expected %q, got %q", id, expected, b)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	apiRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "api_requests_total",
+			Help:      "The number of S3 API calls made by the exporter, by operation and the HTTP status code of the final attempt",
+		},
+		[]string{"operation", "code"},
+	)
+	apiRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "api_request_duration_seconds",
+			Help:      "How long S3 API calls took, adding up every attempt but not the waits for the rate limiter or between retries",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"operation"},
+	)
+	apiRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "api_retries_total",
+			Help:      "The number of times S3 API calls were retried",
+		},
+		[]string{"operation"},
+	)
+	apiThrottles = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "api_throttles_total",
+			Help:      "The number of S3 API attempts that were throttled",
+		},
+		[]string{"operation"},
+	)
+	probeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "probe_duration_seconds",
+			Help:      "How long probes took",
+			Buckets:   []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		},
+		[]string{"module"},
+	)
+	probes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "probes_total",
+			Help:      "The number of probes run, by module and result",
+		},
+		[]string{"module", "result"},
+	)
+)
+
+// instrumentHandlers adds handlers that record every API call made with a
+// client to the exporter's own metrics
+func instrumentHandlers(h *request.Handlers) {
+	h.Validate.PushBackNamed(request.NamedHandler{
+		Name: "s3_exporter.DurationHandler",
+		Fn:   timeAttempts,
+	})
+	h.CompleteAttempt.PushBackNamed(request.NamedHandler{
+		Name: "s3_exporter.ThrottleHandler",
+		Fn: func(r *request.Request) {
+			if r.Error != nil && r.IsErrorThrottle() {
+				apiThrottles.WithLabelValues(r.Operation.Name).Inc()
+			}
+		},
+	})
+	h.Complete.PushBackNamed(request.NamedHandler{
+		Name: "s3_exporter.MetricsHandler",
+		Fn: func(r *request.Request) {
+			code := "error"
+			if r.HTTPResponse != nil && r.HTTPResponse.StatusCode != 0 {
+				code = strconv.Itoa(r.HTTPResponse.StatusCode)
+			}
+			apiRequests.WithLabelValues(r.Operation.Name, code).Inc()
+			if r.RetryCount > 0 {
+				apiRetries.WithLabelValues(r.Operation.Name).Add(float64(r.RetryCount))
+			}
+		},
+	})
+}
+
+// timeAttempts adds handlers to a request that time each attempt from when
+// it's sent until it completes. r.Time and r.AttemptTime are set before the
+// request is signed, so they'd count the wait for the rate limiter, and r.Time
+// the backoff between retries too.
+func timeAttempts(r *request.Request) {
+	var start time.Time
+	var took time.Duration
+	r.Handlers.Send.PushFront(func(r *request.Request) {
+		start = time.Now()
+	})
+	r.Handlers.CompleteAttempt.PushFront(func(r *request.Request) {
+		if !start.IsZero() {
+			took += time.Since(start)
+			start = time.Time{}
+		}
+	})
+	r.Handlers.Complete.PushBack(func(r *request.Request) {
+		apiRequestDuration.WithLabelValues(r.Operation.Name).Observe(took.Seconds())
+	})
+}
+
+// observeProbe records how long a probe took and whether it succeeded
+func observeProbe(module string, start time.Time, success bool) {
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+	probes.WithLabelValues(module, result).Inc()
+	probeDuration.WithLabelValues(module).Observe(time.Since(start).Seconds())
+}
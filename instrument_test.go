@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/time/rate"
+)
+
+// TestInstrumentHandlers checks that calls, retries and throttles are counted
+// for a real client talking to a server that throttles it, and that the time
+// spent waiting for the rate limiter isn't counted as time spent calling S3
+func TestInstrumentHandlers(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+			return
+		}
+		w.Write([]byte(`<ListBucketResult><Name>mock</Name><IsTruncated>false</IsTruncated></ListBucketResult>`))
+	}))
+	defer ts.Close()
+
+	cfg := aws.NewConfig().
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithRegion("us-east-1").
+		WithEndpoint(ts.URL).
+		WithS3ForcePathStyle(true)
+	cfg = request.WithRetryer(cfg, client.DefaultRetryer{
+		NumMaxRetries:    3,
+		MinRetryDelay:    time.Millisecond,
+		MaxRetryDelay:    time.Millisecond,
+		MinThrottleDelay: time.Millisecond,
+		MaxThrottleDelay: time.Millisecond,
+	})
+	svc := s3.New(session.Must(session.NewSession()), cfg)
+	instrumentHandlers(&svc.Handlers)
+	// Each retry waits 50ms for the limiter
+	svc.Handlers.Sign.PushFrontNamed(rateLimitHandler(rate.NewLimiter(rate.Every(50*time.Millisecond), 1)))
+
+	durations := func() (uint64, float64) {
+		var m dto.Metric
+		if err := apiRequestDuration.WithLabelValues("ListObjectsV2").(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	countBefore, sumBefore := durations()
+	before := map[string]float64{
+		"requests":  testutil.ToFloat64(apiRequests.WithLabelValues("ListObjectsV2", "200")),
+		"retries":   testutil.ToFloat64(apiRetries.WithLabelValues("ListObjectsV2")),
+		"throttles": testutil.ToFloat64(apiThrottles.WithLabelValues("ListObjectsV2")),
+	}
+
+	if _, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("mock")}); err != nil {
+		t.Fatal(err)
+	}
+
+	after := map[string]float64{
+		"requests":  testutil.ToFloat64(apiRequests.WithLabelValues("ListObjectsV2", "200")),
+		"retries":   testutil.ToFloat64(apiRetries.WithLabelValues("ListObjectsV2")),
+		"throttles": testutil.ToFloat64(apiThrottles.WithLabelValues("ListObjectsV2")),
+	}
+	expected := map[string]float64{"requests": 1, "retries": 2, "throttles": 2}
+	for name, n := range expected {
+		if after[name]-before[name] != n {
+			t.Errorf("expected %s to go up by %v, went up by %v", name, n, after[name]-before[name])
+		}
+	}
+	countAfter, sumAfter := durations()
+	if countAfter-countBefore != 1 {
+		t.Errorf("expected one duration to be observed, got %d", countAfter-countBefore)
+	}
+	if took := sumAfter - sumBefore; took >= 0.05 {
+		t.Errorf("expected the duration to leave out the rate limiter, got %gs", took)
+	}
+}
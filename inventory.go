@@ -0,0 +1,193 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// inventoryDate matches the folders S3 Inventory writes each report to
+var inventoryDate = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}-\d{2}Z/$`)
+
+// inventoryManifest is the manifest.json that describes an inventory report
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	CreationTimestamp string `json:"creationTimestamp"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key  string `json:"key"`
+		Size int64  `json:"size"`
+	} `json:"files"`
+}
+
+// created returns the time the report was created
+func (m *inventoryManifest) created() time.Time {
+	ms, err := strconv.ParseInt(m.CreationTimestamp, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// listInventory works out the same figures as list from the latest inventory
+// report for the bucket, rather than listing it
+func (e *Exporter) listInventory() (*listResult, error) {
+	inv := e.module.Inventory
+	base := strings.TrimSuffix(inv.Prefix, "/")
+	if base != "" {
+		base = base + "/"
+	}
+	base = base + e.bucket + "/" + inv.ConfigID + "/"
+
+	manifest, err := e.latestManifest(inv.Bucket, base)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.FileFormat != "CSV" {
+		return nil, fmt.Errorf("inventory file format %s isn't supported, only CSV is", manifest.FileFormat)
+	}
+
+	columns := map[string]int{}
+	for i, c := range strings.Split(manifest.FileSchema, ",") {
+		columns[strings.TrimSpace(c)] = i
+	}
+	for _, c := range []string{"Key", "Size", "LastModifiedDate"} {
+		if _, ok := columns[c]; !ok {
+			return nil, fmt.Errorf("inventory report doesn't include the %s field", c)
+		}
+	}
+
+	result := e.newListResult()
+	result.inventoryCreated = manifest.created()
+	seen := map[string]bool{}
+	for _, f := range manifest.Files {
+		if err := e.readInventoryFile(inv.Bucket, f.Key, columns, result, seen); err != nil {
+			return nil, err
+		}
+	}
+	result.commonPrefixes = len(seen)
+
+	return result, nil
+}
+
+// latestManifest finds the most recent complete inventory report under base
+func (e *Exporter) latestManifest(bucket, base string) (*inventoryManifest, error) {
+	var dates []string
+	err := e.lister.ListPages(e.ctx, listQuery{
+		Bucket:    bucket,
+		Prefix:    base,
+		Delimiter: "/",
+	}, func(page *listPage, lastPage bool) bool {
+		for _, cp := range page.CommonPrefixes {
+			if d := strings.TrimPrefix(cp, base); inventoryDate.MatchString(d) {
+				dates = append(dates, d)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The manifest is written once the report is complete, so skip back over
+	// any report that is still being delivered
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	for _, d := range dates {
+		body, err := e.lister.Get(e.ctx, bucket, base+d+"manifest.json", "")
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+
+		m := &inventoryManifest{}
+		if err := json.NewDecoder(body).Decode(m); err != nil {
+			return nil, fmt.Errorf("error decoding inventory manifest %s: %s", base+d+"manifest.json", err)
+		}
+		return m, nil
+	}
+
+	return nil, fmt.Errorf("no inventory reports found in s3://%s/%s", bucket, base)
+}
+
+// readInventoryFile streams a gzipped CSV inventory file, adding the objects
+// that match the probe's prefix to result
+func (e *Exporter) readInventoryFile(bucket, key string, columns map[string]int, result *listResult, commonPrefixes map[string]bool) error {
+	body, err := e.lister.Get(e.ctx, bucket, key, "")
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("error reading inventory file %s: %s", key, err)
+	}
+	defer gz.Close()
+
+	r := csv.NewReader(gz)
+	r.FieldsPerRecord = len(columns)
+	r.ReuseRecord = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading inventory file %s: %s", key, err)
+		}
+
+		// Only count the current version of objects in versioned buckets
+		if i, ok := columns["IsLatest"]; ok && record[i] == "false" {
+			continue
+		}
+		if i, ok := columns["IsDeleteMarker"]; ok && record[i] == "true" {
+			continue
+		}
+
+		objectKey, err := url.QueryUnescape(record[columns["Key"]])
+		if err != nil {
+			return fmt.Errorf("error decoding key %q in inventory file %s: %s", record[columns["Key"]], key, err)
+		}
+		if !strings.HasPrefix(objectKey, e.prefix) {
+			continue
+		}
+		if e.delimiter != "" {
+			if i := strings.Index(objectKey[len(e.prefix):], e.delimiter); i >= 0 {
+				commonPrefixes[objectKey[:len(e.prefix)+i+len(e.delimiter)]] = true
+				continue
+			}
+		}
+
+		size, err := strconv.ParseInt(record[columns["Size"]], 10, 64)
+		if err != nil {
+			return fmt.Errorf("error parsing size of %s in inventory file %s: %s", objectKey, key, err)
+		}
+		lastModified, err := time.Parse(time.RFC3339, record[columns["LastModifiedDate"]])
+		if err != nil {
+			return fmt.Errorf("error parsing last modified date of %s in inventory file %s: %s", objectKey, key, err)
+		}
+		obj := &objectInfo{
+			Key:          objectKey,
+			Size:         size,
+			LastModified: lastModified,
+		}
+		if i, ok := columns["StorageClass"]; ok {
+			obj.StorageClass = record[i]
+		}
+		result.add(obj)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestProbeHandlerInventory checks that the latest complete inventory report
+// is found and read from the fixtures in testdata/inventory
+func TestProbeHandlerInventory(t *testing.T) {
+	svc := newMemS3ClientFromDir(t, "testdata/inventory")
+	conf, err := parseConfig([]byte(`
+modules:
+  inventory:
+    prober: inventory
+    inventory:
+      bucket: inventory-bucket
+      prefix: inventory
+      config_id: daily
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{
+			query: "bucket=source-bucket&prefix=logs/&module=inventory",
+			expected: []string{
+				`s3_list_success{bucket="source-bucket",delimiter="",prefix="logs/"} 1`,
+				`s3_objects{bucket="source-bucket",prefix="logs/"} 3`,
+				`s3_objects_size_sum_bytes{bucket="source-bucket",prefix="logs/"} 450`,
+				`s3_biggest_object_size_bytes{bucket="source-bucket",prefix="logs/"} 300`,
+				`s3_last_modified_object_date{bucket="source-bucket",prefix="logs/"} 1.7921106e+09`,
+				`s3_last_modified_object_size_bytes{bucket="source-bucket",prefix="logs/"} 300`,
+				`s3_storage_class_objects{bucket="source-bucket",prefix="logs/",storage_class="GLACIER"} 1`,
+				`s3_storage_class_objects{bucket="source-bucket",prefix="logs/",storage_class="STANDARD"} 1`,
+				`s3_storage_class_size_sum_bytes{bucket="source-bucket",prefix="logs/",storage_class="STANDARD_IA"} 300`,
+				`s3_inventory_creation_date{bucket="source-bucket",prefix="logs/"} 1.7921124e+09`,
+			},
+		},
+		{
+			query: "bucket=source-bucket&prefix=logs/&delimiter=/&module=inventory",
+			expected: []string{
+				`s3_common_prefixes{bucket="source-bucket",delimiter="/",prefix="logs/"} 2`,
+			},
+		},
+		{
+			query: "bucket=missing-bucket&module=inventory",
+			expected: []string{
+				`s3_list_success{bucket="missing-bucket",delimiter="",prefix=""} 0`,
+			},
+		},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", "/probe?"+tc.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, svc, conf, nil, 0)
+
+		for _, l := range tc.expected {
+			if !strings.Contains(rr.Body.String(), l) {
+				t.Errorf("%s: expected %s", tc.query, l)
+			}
+		}
+	}
+}
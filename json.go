@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+var s3JSONExtractFailures = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "json_extract_failures"),
+	"The number of configured metrics that couldn't be extracted from the object",
+	[]string{"bucket", "key"}, nil,
+)
+
+// JSONConfig configures the json prober, which reads a JSON object and turns
+// the values in it into metrics
+type JSONConfig struct {
+	// MaxSize is the most bytes that will be read, both from S3 and after
+	// decompression
+	MaxSize int64 `yaml:"max_size,omitempty"`
+	// Gzip decompresses the object before it's parsed
+	Gzip    bool         `yaml:"gzip,omitempty"`
+	Metrics []JSONMetric `yaml:"metrics"`
+}
+
+// UnmarshalYAML sets the defaults for a json config and validates it
+func (c *JSONConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain JSONConfig
+	*c = JSONConfig{MaxSize: defaultContentMaxSize}
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("line %d: max_size must be positive", value.Line)
+	}
+	if len(c.Metrics) == 0 {
+		return fmt.Errorf("line %d: json needs at least one metric", value.Line)
+	}
+	names := map[string]bool{}
+	for _, m := range c.Metrics {
+		if names[m.Name] {
+			return fmt.Errorf("line %d: duplicate metric name %q", value.Line, m.Name)
+		}
+		names[m.Name] = true
+	}
+	return nil
+}
+
+// JSONMetric maps a value in a JSON object to a gauge. Expressions are
+// JMESPath. When Each is set, it should select a list and there's a series
+// for each item in it, with Path and the labels evaluated against the item.
+type JSONMetric struct {
+	Name string `yaml:"name"`
+	Help string `yaml:"help,omitempty"`
+	// Each selects a list of items to produce a series for
+	Each string `yaml:"each,omitempty"`
+	// Path selects the value, which can be a number, a boolean or a string
+	// holding a number
+	Path string `yaml:"path"`
+	// Labels maps label names to the expressions for their values
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	each       *jmespath.JMESPath
+	path       *jmespath.JMESPath
+	labelNames []string
+	labels     []*jmespath.JMESPath
+	desc       *prometheus.Desc
+}
+
+// UnmarshalYAML compiles and validates a metric
+func (m *JSONMetric) UnmarshalYAML(value *yaml.Node) error {
+	type plain JSONMetric
+	if err := value.Decode((*plain)(m)); err != nil {
+		return err
+	}
+
+	if !model.IsValidMetricName(model.LabelValue(m.Name)) {
+		return fmt.Errorf("line %d: invalid metric name %q", value.Line, m.Name)
+	}
+	if strings.HasPrefix(m.Name, namespace+"_") {
+		return fmt.Errorf("line %d: metric name %q is in the exporter's own %s_ namespace", value.Line, m.Name, namespace)
+	}
+	if m.Path == "" {
+		return fmt.Errorf("line %d: path must be set for metric %s", value.Line, m.Name)
+	}
+	if m.Help == "" {
+		m.Help = fmt.Sprintf("Extracted from %s in a JSON object in S3", m.Path)
+	}
+
+	var err error
+	if m.Each != "" {
+		if m.each, err = jmespath.Compile(m.Each); err != nil {
+			return fmt.Errorf("line %d: invalid each expression for metric %s: %s", value.Line, m.Name, err)
+		}
+	}
+	if m.path, err = jmespath.Compile(m.Path); err != nil {
+		return fmt.Errorf("line %d: invalid path for metric %s: %s", value.Line, m.Name, err)
+	}
+
+	m.labelNames = nil
+	for name := range m.Labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("line %d: invalid label name %q for metric %s", value.Line, name, m.Name)
+		}
+		if name == "bucket" || name == "key" {
+			return fmt.Errorf("line %d: label %s is added by the exporter and can't be set for metric %s", value.Line, name, m.Name)
+		}
+		m.labelNames = append(m.labelNames, name)
+	}
+	sort.Strings(m.labelNames)
+	m.labels = nil
+	for _, name := range m.labelNames {
+		expr, err := jmespath.Compile(m.Labels[name])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid expression for label %s of metric %s: %s", value.Line, name, m.Name, err)
+		}
+		m.labels = append(m.labels, expr)
+	}
+
+	m.desc = prometheus.NewDesc(m.Name, m.Help, append([]string{"bucket", "key"}, m.labelNames...), nil)
+	return nil
+}
+
+func (e *Exporter) describeJSON(ch chan<- *prometheus.Desc) {
+	ch <- s3ContentReadSuccess
+	ch <- s3ContentReadDuration
+	ch <- s3ContentReadBytes
+	ch <- s3JSONExtractFailures
+	if e.key != e.keyLabel {
+		ch <- s3ResolvedKey
+	}
+	for _, m := range e.module.JSON.Metrics {
+		ch <- m.desc
+	}
+}
+
+// collectJSON reads a JSON object and exposes the values picked out of it
+// by the module
+func (e *Exporter) collectJSON(ch chan<- prometheus.Metric) {
+	if e.key != e.keyLabel {
+		ch <- prometheus.MustNewConstMetric(
+			s3ResolvedKey, prometheus.GaugeValue, 1, e.bucket, e.keyLabel, e.key,
+		)
+	}
+
+	conf := e.module.JSON
+	start := time.Now()
+	raw, err := e.readObject(e.key, "", conf.MaxSize)
+	body := raw
+	if err == nil && conf.Gzip {
+		body, err = gunzip(raw, conf.MaxSize)
+	}
+	var data interface{}
+	if err == nil {
+		if err = json.Unmarshal(body, &data); err != nil {
+			err = fmt.Errorf("error parsing s3://%s/%s as JSON: %s", e.bucket, e.key, err)
+		}
+	}
+	duration := time.Since(start).Seconds()
+	observeProbe(e.moduleName, start, err == nil)
+
+	if err != nil {
+		log.Errorln(err)
+		ch <- prometheus.MustNewConstMetric(
+			s3ContentReadSuccess, prometheus.GaugeValue, 0, e.bucket, e.keyLabel,
+		)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		s3ContentReadSuccess, prometheus.GaugeValue, 1, e.bucket, e.keyLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3ContentReadDuration, prometheus.GaugeValue, duration, e.bucket, e.keyLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3ContentReadBytes, prometheus.GaugeValue, float64(len(raw)), e.bucket, e.keyLabel,
+	)
+
+	failures := 0
+	for _, m := range conf.Metrics {
+		if err := e.collectJSONMetric(ch, m, data); err != nil {
+			log.Errorf("metric %s from s3://%s/%s: %s", m.Name, e.bucket, e.key, err)
+			failures++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(
+		s3JSONExtractFailures, prometheus.GaugeValue, float64(failures), e.bucket, e.keyLabel,
+	)
+}
+
+// collectJSONMetric extracts the series for one metric from data. Nothing is
+// sent unless every series could be extracted.
+func (e *Exporter) collectJSONMetric(ch chan<- prometheus.Metric, m JSONMetric, data interface{}) error {
+	items := []interface{}{data}
+	if m.each != nil {
+		result, err := m.each.Search(data)
+		if err != nil {
+			return err
+		}
+		list, ok := result.([]interface{})
+		if !ok {
+			return fmt.Errorf("each expression %s didn't select a list", m.Each)
+		}
+		items = list
+	}
+
+	seen := map[string]bool{}
+	metrics := make([]prometheus.Metric, 0, len(items))
+	for _, item := range items {
+		result, err := m.path.Search(item)
+		if err != nil {
+			return err
+		}
+		v, err := jsonNumber(result)
+		if err != nil {
+			return fmt.Errorf("path %s: %s", m.Path, err)
+		}
+
+		values := []string{e.bucket, e.keyLabel}
+		for _, expr := range m.labels {
+			result, err := expr.Search(item)
+			if err != nil {
+				return err
+			}
+			if result == nil {
+				values = append(values, "")
+				continue
+			}
+			values = append(values, jsonText(result))
+		}
+
+		// Two items with the same labels would fail the whole scrape
+		id := strings.Join(values, "\xff")
+		if seen[id] {
+			return fmt.Errorf("more than one series with the labels %v", values[2:])
+		}
+		seen[id] = true
+
+		metrics = append(metrics, prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, v, values...))
+	}
+	for _, metric := range metrics {
+		ch <- metric
+	}
+	return nil
+}
+
+// jsonNumber turns the result of a JMESPath expression into a sample value
+func jsonNumber(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case bool:
+		if t {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q isn't a number", t)
+		}
+		return f, nil
+	case nil:
+		return 0, fmt.Errorf("no value found")
+	default:
+		return 0, fmt.Errorf("%s isn't a number", jsonText(t))
+	}
+}
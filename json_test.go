@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestProbeHandlerJSON checks that values are picked out of a JSON object,
+// with labels, and that values that can't be are counted
+func TestProbeHandlerJSON(t *testing.T) {
+	svc := newMemS3Client(nil)
+	svc.bodies = map[string][]byte{
+		"jobs/nightly/metrics.json": []byte(`{
+			"job": "nightly",
+			"finished": "1792112400",
+			"success": true,
+			"records": {"processed": 1234, "failed": 5},
+			"tables": [
+				{"name": "users", "rows": 100},
+				{"name": "orders", "rows": 2000}
+			]
+		}`),
+		"jobs/broken/metrics.json":  []byte(`{"job": "broken", "success": "yes", "tables": [{"name": "a", "rows": 1}, {"name": "a", "rows": 2}]}`),
+		"jobs/partial/metrics.json": []byte(`{"tables": [{"name": "a", "rows": 1}, {"name": "b", "rows": "lots"}]}`),
+		"jobs/notjson":              []byte(`not json`),
+	}
+	conf, err := parseConfig([]byte(`
+modules:
+  batch:
+    prober: json
+    json:
+      metrics:
+        - name: batch_last_finished_timestamp_seconds
+          help: When the job last finished
+          path: finished
+        - name: batch_success
+          path: success
+          labels:
+            job: job
+        - name: batch_records_processed
+          path: records.processed
+        - name: batch_table_rows
+          each: tables
+          path: rows
+          labels:
+            table: name
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key      string
+		expected []string
+		missing  []string
+	}{
+		{
+			key: "jobs/nightly/metrics.json",
+			expected: []string{
+				`# HELP batch_last_finished_timestamp_seconds When the job last finished`,
+				`batch_last_finished_timestamp_seconds{bucket="mock",key="jobs/nightly/metrics.json"} 1.7921124e+09`,
+				`batch_success{bucket="mock",job="nightly",key="jobs/nightly/metrics.json"} 1`,
+				`batch_records_processed{bucket="mock",key="jobs/nightly/metrics.json"} 1234`,
+				`batch_table_rows{bucket="mock",key="jobs/nightly/metrics.json",table="users"} 100`,
+				`batch_table_rows{bucket="mock",key="jobs/nightly/metrics.json",table="orders"} 2000`,
+				`s3_json_extract_failures{bucket="mock",key="jobs/nightly/metrics.json"} 0`,
+			},
+		},
+		{
+			key: "jobs/broken/metrics.json",
+			expected: []string{
+				`s3_object_content_read_success{bucket="mock",key="jobs/broken/metrics.json"} 1`,
+				`s3_json_extract_failures{bucket="mock",key="jobs/broken/metrics.json"} 4`,
+			},
+		},
+		{
+			// A metric that fails part way through an each list has no
+			// series at all
+			key: "jobs/partial/metrics.json",
+			expected: []string{
+				`s3_json_extract_failures{bucket="mock",key="jobs/partial/metrics.json"} 4`,
+			},
+			missing: []string{"batch_table_rows"},
+		},
+		{
+			key: "jobs/notjson",
+			expected: []string{
+				`s3_object_content_read_success{bucket="mock",key="jobs/notjson"} 0`,
+			},
+		},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest("GET", "/probe?bucket=mock&module=batch&key="+tc.key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, svc, conf, nil, 0)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected a 200, got %d: %s", tc.key, rr.Code, rr.Body.String())
+		}
+		for _, l := range tc.expected {
+			if !strings.Contains(rr.Body.String(), l) {
+				t.Errorf("%s: expected %s", tc.key, l)
+			}
+		}
+		for _, l := range tc.missing {
+			if strings.Contains(rr.Body.String(), l) {
+				t.Errorf("%s: didn't expect %s in:\n%s", tc.key, l, rr.Body.String())
+			}
+		}
+	}
+}
+
+// TestParseJSONConfig checks that bad metrics are caught when the
+// configuration is loaded
+func TestParseJSONConfig(t *testing.T) {
+	invalid := map[string]string{
+		"no metrics": `
+modules:
+  foo:
+    prober: json
+    json:
+      gzip: true
+`,
+		"bad name": `
+modules:
+  foo:
+    prober: json
+    json:
+      metrics:
+        - name: 1abc
+          path: a
+`,
+		"exporter's name": `
+modules:
+  foo:
+    prober: json
+    json:
+      metrics:
+        - name: s3_object_content_read_success
+          path: a
+`,
+		"no path": `
+modules:
+  foo:
+    prober: json
+    json:
+      metrics:
+        - name: abc
+`,
+		"bad path": `
+modules:
+  foo:
+    prober: json
+    json:
+      metrics:
+        - name: abc
+          path: 'a.['
+`,
+		"reserved label": `
+modules:
+  foo:
+    prober: json
+    json:
+      metrics:
+        - name: abc
+          path: a
+          labels:
+            bucket: b
+`,
+		"duplicate name": `
+modules:
+  foo:
+    prober: json
+    json:
+      metrics:
+        - name: abc
+          path: a
+        - name: abc
+          path: b
+`,
+	}
+	for name, conf := range invalid {
+		if _, err := parseConfig([]byte(conf)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if !strings.Contains(err.Error(), "line ") {
+			t.Errorf("%s: expected the error to include a line number, got %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+var (
+	probeQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "probe_queue_depth",
+			Help:      "The number of probes waiting for a concurrency slot",
+		},
+	)
+	probeQueueWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "probe_queue_wait_seconds",
+			Help:      "How long probes waited for a concurrency slot",
+			Buckets:   []float64{.001, .01, .1, .5, 1, 2.5, 5, 10, 30},
+		},
+	)
+	probeRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "probe_rejections_total",
+			Help:      "The number of probes rejected because no concurrency slot became available",
+		},
+		[]string{"reason"},
+	)
+	apiRateLimitWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "api_rate_limit_wait_seconds",
+			Help:      "How long S3 API requests waited for the rate limiter",
+			Buckets:   []float64{.001, .01, .1, .5, 1, 2.5, 5, 10},
+		},
+	)
+)
+
+var errProbeQueueTimeout = errors.New("timed out waiting for a free probe slot")
+
+// probeLimiter bounds the number of probes that run at the same time, both
+// across the whole exporter and for any single bucket. Probes that can't get a
+// slot straight away queue for up to timeout before they are rejected.
+type probeLimiter struct {
+	global    chan struct{}
+	perBucket int
+	timeout   time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*bucketSlots
+}
+
+// bucketSlots are the slots for one bucket, along with the number of probes
+// holding or waiting for one. They're dropped once there are none, so
+// bucket names that are only probed once aren't kept around.
+type bucketSlots struct {
+	slots chan struct{}
+	refs  int
+}
+
+// newProbeLimiter returns a limiter allowing maxConcurrent probes in total and
+// maxPerBucket probes per bucket. A limit of 0 means unlimited.
+func newProbeLimiter(maxConcurrent, maxPerBucket int, timeout time.Duration) *probeLimiter {
+	l := &probeLimiter{
+		perBucket: maxPerBucket,
+		timeout:   timeout,
+		buckets:   map[string]*bucketSlots{},
+	}
+	if maxConcurrent > 0 {
+		l.global = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+// bucketSlots returns the slots for bucket, which must be handed back with
+// releaseBucket
+func (l *probeLimiter) bucketSlots(bucket string) chan struct{} {
+	if l.perBucket <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[bucket]
+	if !ok {
+		b = &bucketSlots{slots: make(chan struct{}, l.perBucket)}
+		l.buckets[bucket] = b
+	}
+	b.refs++
+	return b.slots
+}
+
+// releaseBucket hands back the slots returned by bucketSlots
+func (l *probeLimiter) releaseBucket(bucket string) {
+	if l.perBucket <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[bucket]
+	b.refs--
+	if b.refs == 0 {
+		delete(l.buckets, bucket)
+	}
+}
+
+// acquire waits for a slot for bucket and returns a function that releases
+// it. A nil limiter never blocks.
+func (l *probeLimiter) acquire(ctx context.Context, bucket string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	probeQueueDepth.Inc()
+	defer probeQueueDepth.Dec()
+
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	// Take the bucket slot first so a busy bucket doesn't hold on to global
+	// slots that probes for other buckets could be using
+	bucketSlots := l.bucketSlots(bucket)
+	if err := take(ctx, bucketSlots); err != nil {
+		l.releaseBucket(bucket)
+		return nil, l.reject(err)
+	}
+	if err := take(ctx, l.global); err != nil {
+		give(bucketSlots)
+		l.releaseBucket(bucket)
+		return nil, l.reject(err)
+	}
+	probeQueueWait.Observe(time.Since(start).Seconds())
+
+	return func() {
+		give(l.global)
+		give(bucketSlots)
+		l.releaseBucket(bucket)
+	}, nil
+}
+
+func (l *probeLimiter) reject(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		probeRejections.WithLabelValues("timeout").Inc()
+		return errProbeQueueTimeout
+	}
+	probeRejections.WithLabelValues("canceled").Inc()
+	return err
+}
+
+func take(ctx context.Context, slots chan struct{}) error {
+	if slots == nil {
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func give(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// rateLimitHandler returns a request handler that holds every attempt of an
+// API call, retries included, until the token bucket allows it through
+func rateLimitHandler(limiter *rate.Limiter) request.NamedHandler {
+	return request.NamedHandler{
+		Name: "s3_exporter.RateLimitHandler",
+		Fn: func(r *request.Request) {
+			start := time.Now()
+			if err := limiter.Wait(r.Context()); err != nil {
+				r.Error = awserr.New(request.CanceledErrorCode, "rate limiter wait canceled", err)
+				return
+			}
+			apiRateLimitWait.Observe(time.Since(start).Seconds())
+		},
+	}
+}
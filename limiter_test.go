@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestProbeLimiter checks that global and per-bucket slots are enforced and
+// handed back on release, and that buckets without probes aren't kept
+func TestProbeLimiter(t *testing.T) {
+	l := newProbeLimiter(2, 1, 10*time.Millisecond)
+
+	releaseA, err := l.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("unexpected error acquiring first slot for a: %s", err)
+	}
+
+	if _, err := l.acquire(context.Background(), "a"); err != errProbeQueueTimeout {
+		t.Errorf("expected second probe for a to time out, got %v", err)
+	}
+
+	releaseB, err := l.acquire(context.Background(), "b")
+	if err != nil {
+		t.Fatalf("unexpected error acquiring slot for b: %s", err)
+	}
+
+	if _, err := l.acquire(context.Background(), "c"); err != errProbeQueueTimeout {
+		t.Errorf("expected probe for c to time out on the global limit, got %v", err)
+	}
+
+	releaseA()
+	releaseB()
+
+	releaseC, err := l.acquire(context.Background(), "c")
+	if err != nil {
+		t.Errorf("expected slot for c after release, got %s", err)
+	} else {
+		releaseC()
+	}
+
+	if len(l.buckets) != 0 {
+		t.Errorf("expected the slots of every bucket to be dropped once released, got %d", len(l.buckets))
+	}
+}
+
+// TestProbeHandlerRejected checks that a probe which can't get a slot is
+// answered with a 503
+func TestProbeHandlerRejected(t *testing.T) {
+	l := newProbeLimiter(1, 0, 10*time.Millisecond)
+	release, err := l.acquire(context.Background(), "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	req, err := http.NewRequest("GET", "/probe?bucket=mock&prefix=one", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, mockSvc, defaultConfig(), l, 0)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+}
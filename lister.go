@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// listResult holds the figures worked out from listing a bucket/prefix
+type listResult struct {
+	objects         int64
+	totalSize       int64
+	biggestSize     int64
+	lastModified    time.Time
+	lastModifiedKey string
+	lastObjectSize  int64
+	// The same for the object that was modified longest ago
+	firstModified    time.Time
+	firstModifiedKey string
+	firstObjectSize  int64
+	commonPrefixes   int
+	truncated        bool
+	storageClasses   map[string]*storageClassTotal
+	// inventoryCreated is when the inventory report the result was read
+	// from was created
+	inventoryCreated time.Time
+	// digests of every object, kept when keepDigests is set for the state
+	keepDigests bool
+	digests     []objectDigest
+	// lastKey is the greatest key counted
+	lastKey string
+	// incremental is set when the result is the totals of an earlier
+	// listing with only the keys after it listed, and lastFullList is when
+	// the whole prefix was last listed
+	incremental  bool
+	lastFullList time.Time
+}
+
+// newListResult returns an empty result, which keeps the digests of the
+// objects if the probe has state
+func (e *Exporter) newListResult() *listResult {
+	return &listResult{keepDigests: e.state != nil}
+}
+
+// storageClasses is whether the probe reports the objects in each storage
+// class
+func (e *Exporter) storageClasses() bool {
+	return e.module.Prober == "inventory" || e.module.StorageClasses
+}
+
+// storageClassTotal is the number and size of objects in a storage class
+type storageClassTotal struct {
+	objects   int64
+	totalSize int64
+}
+
+// add counts an object towards the result. When several objects were
+// modified at the same time, the first in key order wins, as it would for a
+// listing.
+func (r *listResult) add(item *objectInfo) {
+	r.objects++
+	r.totalSize = r.totalSize + item.Size
+	if item.LastModified.After(r.lastModified) || r.objects == 1 ||
+		(item.LastModified.Equal(r.lastModified) && item.Key < r.lastModifiedKey) {
+		r.lastModified = item.LastModified
+		r.lastModifiedKey = item.Key
+		r.lastObjectSize = item.Size
+	}
+	if item.LastModified.Before(r.firstModified) || r.objects == 1 ||
+		(item.LastModified.Equal(r.firstModified) && item.Key < r.firstModifiedKey) {
+		r.firstModified = item.LastModified
+		r.firstModifiedKey = item.Key
+		r.firstObjectSize = item.Size
+	}
+	if item.Size > r.biggestSize {
+		r.biggestSize = item.Size
+	}
+	if item.StorageClass != "" {
+		r.addStorageClass(item.StorageClass, 1, item.Size)
+	}
+	if r.keepDigests {
+		r.digests = append(r.digests, digestObject(item))
+	}
+	if item.Key > r.lastKey {
+		r.lastKey = item.Key
+	}
+}
+
+func (r *listResult) addStorageClass(class string, objects, size int64) {
+	if r.storageClasses == nil {
+		r.storageClasses = map[string]*storageClassTotal{}
+	}
+	t, ok := r.storageClasses[class]
+	if !ok {
+		t = &storageClassTotal{}
+		r.storageClasses[class] = t
+	}
+	t.objects = t.objects + objects
+	t.totalSize = t.totalSize + size
+}
+
+// merge folds the result of listing another part of the key space into r,
+// giving the same answer as if the objects had been listed in one go
+func (r *listResult) merge(o *listResult) {
+	if o.objects > 0 && (r.objects == 0 || o.lastModified.After(r.lastModified) ||
+		(o.lastModified.Equal(r.lastModified) && o.lastModifiedKey < r.lastModifiedKey)) {
+		r.lastModified = o.lastModified
+		r.lastModifiedKey = o.lastModifiedKey
+		r.lastObjectSize = o.lastObjectSize
+	}
+	if o.objects > 0 && (r.objects == 0 || o.firstModified.Before(r.firstModified) ||
+		(o.firstModified.Equal(r.firstModified) && o.firstModifiedKey < r.firstModifiedKey)) {
+		r.firstModified = o.firstModified
+		r.firstModifiedKey = o.firstModifiedKey
+		r.firstObjectSize = o.firstObjectSize
+	}
+	r.objects = r.objects + o.objects
+	r.totalSize = r.totalSize + o.totalSize
+	r.commonPrefixes = r.commonPrefixes + o.commonPrefixes
+	r.truncated = r.truncated || o.truncated
+	if o.biggestSize > r.biggestSize {
+		r.biggestSize = o.biggestSize
+	}
+	for class, t := range o.storageClasses {
+		r.addStorageClass(class, t.objects, t.totalSize)
+	}
+	r.digests = append(r.digests, o.digests...)
+	if o.lastKey > r.lastKey {
+		r.lastKey = o.lastKey
+	}
+}
+
+// listBudget caps how many objects and pages a probe lists, across all of
+// its shards
+type listBudget struct {
+	maxObjects int64
+	maxPages   int64
+	objects    int64
+	pages      int64
+}
+
+// takePage is called for every page that comes back. It returns false if the
+// page is over budget and shouldn't be used.
+func (b *listBudget) takePage() bool {
+	n := atomic.AddInt64(&b.pages, 1)
+	return b.maxPages <= 0 || n <= b.maxPages
+}
+
+// pagesLeft reports whether another page can be requested
+func (b *listBudget) pagesLeft() bool {
+	return b.maxPages <= 0 || atomic.LoadInt64(&b.pages) < b.maxPages
+}
+
+// takeObject is called for every object. It returns false if the object is
+// over budget and shouldn't be counted.
+func (b *listBudget) takeObject() bool {
+	n := atomic.AddInt64(&b.objects, 1)
+	return b.maxObjects <= 0 || n <= b.maxObjects
+}
+
+// listPages runs query page by page, sets the page size and keeps within the
+// budget. fn is called for each page and can return false to stop early. The
+// result is marked as truncated if the budget ran out before the end of the
+// listing.
+func (e *Exporter) listPages(ctx context.Context, query listQuery, b *listBudget, result *listResult, fn func(*listPage) bool) error {
+	return e.listPagesFrom(ctx, e.lister, query, b, result, fn)
+}
+
+// listPagesFrom is listPages for a listing from somewhere other than the
+// probe's own storage
+func (e *Exporter) listPagesFrom(ctx context.Context, l ObjectLister, query listQuery, b *listBudget, result *listResult, fn func(*listPage) bool) error {
+	query.MaxKeys = e.module.PageSize
+	return l.ListPages(ctx, query, func(page *listPage, lastPage bool) bool {
+		if !b.takePage() {
+			result.truncated = true
+			return false
+		}
+		if !fn(page) {
+			return false
+		}
+		if !lastPage && !b.pagesLeft() {
+			result.truncated = true
+			return false
+		}
+		return true
+	})
+}
+
+// tailObjects lists the objects under the prefix after startAfter, in key
+// order, and calls read for each of them. It stops at the first object stop
+// returns true for, or when the probe runs out of budget, which it reports.
+func (e *Exporter) tailObjects(startAfter string, stop func(*objectInfo) bool, read func(*objectInfo) error) (bool, error) {
+	b := &listBudget{
+		maxObjects: e.module.MaxObjects,
+		maxPages:   e.module.MaxPages,
+	}
+	result := &listResult{}
+	query := listQuery{Bucket: e.bucket, Prefix: e.prefix, StartAfter: startAfter}
+	var readErr error
+	err := e.listPages(e.ctx, query, b, result, func(page *listPage) bool {
+		for i := range page.Objects {
+			o := &page.Objects[i]
+			if stop(o) {
+				return false
+			}
+			if !b.takeObject() {
+				result.truncated = true
+				return false
+			}
+			if readErr = read(o); readErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = readErr
+	}
+	return result.truncated, err
+}
+
+// addObjects counts the objects in a page towards result, up to endAt if
+// it's set. It returns false once there's no need to see any more objects.
+func addObjects(page *listPage, b *listBudget, result *listResult, endAt string) bool {
+	for i := range page.Objects {
+		item := &page.Objects[i]
+		if endAt != "" && item.Key > endAt {
+			return false
+		}
+		if !b.takeObject() {
+			result.truncated = true
+			return false
+		}
+		result.add(item)
+	}
+	return true
+}
+
+// shard is a part of the key space under a prefix. Keys greater than
+// startAfter, up to and including endAt, belong to the shard. Either bound
+// can be empty.
+type shard struct {
+	prefix     string
+	startAfter string
+	endAt      string
+}
+
+// list lists the bucket/prefix the exporter was created for
+func (e *Exporter) list() (*listResult, error) {
+	if e.module.Prober == "inventory" {
+		return e.listInventory()
+	}
+
+	b := &listBudget{
+		maxObjects: e.module.MaxObjects,
+		maxPages:   e.module.MaxPages,
+	}
+	if e.module.Parallel != nil && e.delimiter == "" {
+		return e.listParallel(e.module.Parallel, b)
+	}
+	if e.module.Incremental != nil && e.delimiter == "" {
+		return e.listIncremental(b)
+	}
+
+	result := e.newListResult()
+	query := listQuery{
+		Bucket:    e.bucket,
+		Prefix:    e.prefix,
+		Delimiter: e.delimiter,
+	}
+
+	// Continue making requests until we've listed and compared the date of every object
+	err := e.listPages(e.ctx, query, b, result, func(page *listPage) bool {
+		result.commonPrefixes = result.commonPrefixes + len(page.CommonPrefixes)
+		return addObjects(page, b, result, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// listShard lists the objects in a single shard
+func (e *Exporter) listShard(ctx context.Context, s shard, b *listBudget) (*listResult, error) {
+	result := e.newListResult()
+	query := listQuery{
+		Bucket:     e.bucket,
+		Prefix:     s.prefix,
+		StartAfter: s.startAfter,
+	}
+
+	err := e.listPages(ctx, query, b, result, func(page *listPage) bool {
+		return addObjects(page, b, result, s.endAt)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// shards splits the prefix into shards according to the parallel config. When
+// sharding by delimiter, the objects found directly under the prefix are
+// counted towards result.
+func (e *Exporter) shards(p *ParallelConfig, b *listBudget, result *listResult) ([]shard, error) {
+	var shards []shard
+
+	if p.ShardBy == "delimiter" {
+		query := listQuery{
+			Bucket:    e.bucket,
+			Prefix:    e.prefix,
+			Delimiter: p.Delimiter,
+		}
+		err := e.listPages(e.ctx, query, b, result, func(page *listPage) bool {
+			for _, cp := range page.CommonPrefixes {
+				shards = append(shards, shard{prefix: cp})
+			}
+			return addObjects(page, b, result, "")
+		})
+		return shards, err
+	}
+
+	startAfter := ""
+	for _, b := range p.boundaries(e.prefix) {
+		shards = append(shards, shard{prefix: e.prefix, startAfter: startAfter, endAt: b})
+		startAfter = b
+	}
+	shards = append(shards, shard{prefix: e.prefix, startAfter: startAfter})
+
+	return shards, nil
+}
+
+// listParallel splits the prefix into shards and lists them with a bounded
+// pool of workers, merging the results in key order
+func (e *Exporter) listParallel(p *ParallelConfig, b *listBudget) (*listResult, error) {
+	result := e.newListResult()
+	shards, err := e.shards(p, b, result)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(e.ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	results := make([]*listResult, len(shards))
+	work := make(chan int)
+	for w := 0; w < p.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				r, err := e.listShard(ctx, shards[i], b)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					// No point listing the other shards now
+					cancel()
+					continue
+				}
+				results[i] = r
+			}
+		}()
+	}
+	for i := range shards {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	for _, r := range results {
+		result.merge(r)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// memS3Client lists objects held in memory the way S3 would, honouring the
+// prefix, delimiter and start after parameters and returning small pages
+type memS3Client struct {
+	s3iface.S3API
+	objects  []*s3.Object
+	bodies   map[string][]byte
+	metadata map[string]map[string]*string
+	errs     map[string]error
+	pageSize int
+}
+
+func newMemS3Client(objects []*s3.Object) *memS3Client {
+	sort.Slice(objects, func(i, j int) bool {
+		return *objects[i].Key < *objects[j].Key
+	})
+	return &memS3Client{objects: objects, pageSize: 3}
+}
+
+// newMemS3ClientFromDir serves the files under dir as objects, keyed by their
+// path relative to dir
+func newMemS3ClientFromDir(t *testing.T, dir string) *memS3Client {
+	bodies := map[string][]byte{}
+	var objects []*s3.Object
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		bodies[key] = b
+		objects = append(objects, &s3.Object{
+			Key:          aws.String(key),
+			LastModified: aws.Time(info.ModTime()),
+			Size:         aws.Int64(info.Size()),
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemS3Client(objects)
+	m.bodies = bodies
+	return m
+}
+
+func (m *memS3Client) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	key := aws.StringValue(input.Key)
+	if err, ok := m.errs[key]; ok {
+		return nil, err
+	}
+	for _, o := range m.objects {
+		if *o.Key == key {
+			return &s3.HeadObjectOutput{
+				ContentLength: o.Size,
+				LastModified:  o.LastModified,
+				Metadata:      m.metadata[key],
+			}, nil
+		}
+	}
+	return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "")
+}
+
+func (m *memS3Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if err, ok := m.errs[aws.StringValue(input.Key)]; ok {
+		return nil, err
+	}
+	b, ok := m.bodies[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	if input.Range != nil {
+		var first, last int
+		if _, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &first, &last); err != nil {
+			return nil, err
+		}
+		if last >= len(b) {
+			last = len(b) - 1
+		}
+		b = b[first : last+1]
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: aws.Int64(int64(len(b))),
+	}, nil
+}
+
+// PutObjectWithContext stores the body, without adding it to the listing
+func (m *memS3Client) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if m.bodies == nil {
+		m.bodies = map[string][]byte{}
+	}
+	m.bodies[aws.StringValue(input.Key)] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *memS3Client) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	prefix := aws.StringValue(input.Prefix)
+	delimiter := aws.StringValue(input.Delimiter)
+	startAfter := aws.StringValue(input.StartAfter)
+	pageSize := m.pageSize
+	if input.MaxKeys != nil {
+		pageSize = int(*input.MaxKeys)
+	}
+
+	page := &s3.ListObjectsV2Output{}
+	seen := map[string]bool{}
+	for _, o := range m.objects {
+		key := *o.Key
+		if !strings.HasPrefix(key, prefix) || key <= startAfter {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				cp := key[:len(prefix)+i+len(delimiter)]
+				if !seen[cp] {
+					seen[cp] = true
+					page.CommonPrefixes = append(page.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(cp)})
+				}
+				continue
+			}
+		}
+		page.Contents = append(page.Contents, o)
+		if len(page.Contents) == pageSize {
+			if !fn(page, false) {
+				return nil
+			}
+			page = &s3.ListObjectsV2Output{}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	fn(page, true)
+
+	return nil
+}
+
+func memObjects() []*s3.Object {
+	base := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	var objects []*s3.Object
+	for i, k := range []string{
+		"data/0a/1", "data/0a/2", "data/3f/1", "data/7c", "data/9/x/y",
+		"data/a0/1", "data/a0/2", "data/b", "data/f/1", "data/f/2", "data/zz",
+		"data/", "data/_index", "other/1",
+	} {
+		objects = append(objects, &s3.Object{
+			Key: aws.String(k),
+			// A few objects share a modification time to check that ties
+			// are broken the same way
+			LastModified: aws.Time(base.Add(time.Duration(i%5) * time.Hour)),
+			Size:         aws.Int64(int64(100 + i)),
+		})
+	}
+	return objects
+}
+
+// TestListParallel checks that each way of sharding a prefix adds up to
+// the same result as listing it in one go
+func TestListParallel(t *testing.T) {
+	svc := newMemS3Client(memObjects())
+
+	sequential := &Exporter{ctx: context.Background(), bucket: "mock", prefix: "data/", lister: &s3Lister{svc: svc}}
+	expected, err := sequential.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected.objects != 13 {
+		t.Fatalf("expected 13 objects listed sequentially, got %d", expected.objects)
+	}
+
+	configs := []*ParallelConfig{
+		{ShardBy: "delimiter", Delimiter: "/", Workers: 2},
+		{ShardBy: "range", Charset: "0123456789abcdef", Workers: 4},
+		{ShardBy: "range", StartAfter: []string{"7c", "a"}, Workers: 1},
+		{ShardBy: "range", Charset: "f0", StartAfter: []string{"9/x"}, Workers: 16},
+	}
+	for _, p := range configs {
+		t.Run(fmt.Sprintf("%s %q %q", p.ShardBy, p.Charset, p.StartAfter), func(t *testing.T) {
+			e := &Exporter{
+				ctx:    context.Background(),
+				bucket: "mock",
+				prefix: "data/",
+				module: Module{Parallel: p},
+				lister: &s3Lister{svc: svc},
+			}
+			result, err := e.list()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result, expected) {
+				t.Errorf("expected %+v, got %+v", *expected, *result)
+			}
+		})
+	}
+}
+
+// TestListParallelCanceled checks that a parallel listing stops when the
+// probe is canceled
+func TestListParallelCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	e := &Exporter{
+		ctx:    ctx,
+		bucket: "mock",
+		prefix: "data/",
+		module: Module{Parallel: &ParallelConfig{ShardBy: "range", Charset: "0123456789abcdef", Workers: 2}},
+		lister: &s3Lister{svc: newMemS3Client(memObjects())},
+	}
+	if _, err := e.list(); err == nil {
+		t.Errorf("expected an error listing with a canceled context")
+	}
+}
+
+// TestListBudget checks that listing stops and is flagged as truncated once
+// the module's budget is spent
+func TestListBudget(t *testing.T) {
+	svc := newMemS3Client(memObjects())
+
+	tests := []struct {
+		name      string
+		module    Module
+		objects   int64
+		truncated bool
+	}{
+		{"no budget", Module{}, 13, false},
+		{"max pages", Module{MaxPages: 2}, 6, true},
+		{"page size", Module{PageSize: 2, MaxPages: 2}, 4, true},
+		{"max objects", Module{MaxObjects: 5}, 5, true},
+		{"budget not reached", Module{MaxObjects: 13, MaxPages: 5}, 13, false},
+		{"parallel max objects", Module{MaxObjects: 4, Parallel: &ParallelConfig{ShardBy: "range", Charset: "0a", Workers: 3}}, 4, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &Exporter{
+				ctx:    context.Background(),
+				bucket: "mock",
+				prefix: "data/",
+				module: tc.module,
+				lister: &s3Lister{svc: svc},
+			}
+			result, err := e.list()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.objects != tc.objects {
+				t.Errorf("expected %d objects, got %d", tc.objects, result.objects)
+			}
+			if result.truncated != tc.truncated {
+				t.Errorf("expected truncated to be %t", tc.truncated)
+			}
+		})
+	}
+}
+
+// TestProbeHandlerStorageClasses checks that list probes only report storage
+// classes when the module asks for them
+func TestProbeHandlerStorageClasses(t *testing.T) {
+	conf, err := parseConfig([]byte(`
+modules:
+  storage_classes:
+    storage_classes: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := memObjects()
+	for i, o := range objects {
+		o.StorageClass = aws.String([]string{"STANDARD", "GLACIER"}[i%2])
+	}
+	svc := newMemS3Client(objects)
+
+	for module, expected := range map[string]bool{defaultModule: false, "storage_classes": true} {
+		req, err := http.NewRequest("GET", "/probe?bucket=mock&prefix=data/&module="+module, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, svc, conf, nil, 0)
+
+		l := `s3_storage_class_objects{bucket="mock",prefix="data/",storage_class="GLACIER"} 6`
+		if strings.Contains(rr.Body.String(), l) != expected {
+			t.Errorf("%s: expected %s in the output to be %t:\n%s", module, l, expected, rr.Body.String())
+		}
+	}
+}
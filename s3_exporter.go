@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
+	"golang.org/x/time/rate"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -58,6 +65,46 @@ var (
 		"The size of the biggest object",
 		[]string{"bucket", "prefix"}, nil,
 	)
+	s3StorageClassObjects = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "storage_class_objects"),
+		"The number of objects in each storage class",
+		[]string{"bucket", "prefix", "storage_class"}, nil,
+	)
+	s3StorageClassSize = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "storage_class_size_sum_bytes"),
+		"The total size of the objects in each storage class",
+		[]string{"bucket", "prefix", "storage_class"}, nil,
+	)
+	s3InventoryCreationDate = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "inventory_creation_date"),
+		"When the inventory report the metrics were worked out from was created",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3FreshnessOK = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "freshness_ok"),
+		"If the objects meet the max_age, min_objects and min_size expected of them",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3ExpectedMaxAge = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "expected_max_age_seconds"),
+		"How long ago the most recently modified object is expected to have been modified, at most",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3ResolvedPrefix = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "resolved_prefix_info"),
+		"The prefix that was listed, after evaluating the template in the prefix parameter",
+		[]string{"bucket", "prefix", "resolved_prefix"}, nil,
+	)
+	s3ListFailure = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "list_failure"),
+		"Why the ListObjects operation failed",
+		[]string{"bucket", "prefix", "delimiter", "reason"}, nil,
+	)
+	s3ListTruncated = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "list_truncated"),
+		"If the list operation stopped early because it reached the module's max_objects or max_pages",
+		[]string{"bucket", "prefix", "delimiter"}, nil,
+	)
 	s3CommonPrefixes = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "common_prefixes"),
 		"A count of all the keys between the prefix and the next occurrence of the string specified by the delimiter",
@@ -65,24 +112,94 @@ var (
 	)
 )
 
-// Exporter is our exporter type
+// Exporter is our exporter type. The prefix is what gets listed, and
+// prefixLabel is the prefix as it was given to the probe, which can be a
+// template the prefix was worked out from. The same goes for key and keyLabel
+// with the probers that check a single object.
 type Exporter struct {
-	bucket    string
-	prefix    string
-	delimiter string
-	svc       s3iface.S3API
+	ctx         context.Context
+	bucket      string
+	prefix      string
+	prefixLabel string
+	delimiter   string
+	key         string
+	keyLabel    string
+	moduleName  string
+	module      Module
+	expect      Expectations
+	lister      ObjectLister
+	// state keeps listings between probes, when the module has it
+	state stateStore
+	// The destination the compare prober checks against
+	destBucket      string
+	destPrefix      string
+	destPrefixLabel string
+	destLister      ObjectLister
 }
 
 // Describe all the metrics we export
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	switch e.module.Prober {
+	case "head":
+		e.describeHead(ch)
+		return
+	case "content":
+		e.describeContent(ch)
+		return
+	case "json":
+		e.describeJSON(ch)
+		return
+	case "compare":
+		e.describeCompare(ch)
+		return
+	case "cloudwatch":
+		e.describeCloudWatch(ch)
+		return
+	case "accesslog":
+		e.describeAccessLog(ch)
+		return
+	case "cloudtrail":
+		e.describeCloudTrail(ch)
+		return
+	case "textfile":
+		// The metrics in the files aren't known until they're read, so
+		// nothing is described and the exporter is an unchecked collector
+		return
+	}
+
 	ch <- s3ListSuccess
 	ch <- s3ListDuration
+	ch <- s3ListFailure
+	ch <- s3ListTruncated
+	if e.prefix != e.prefixLabel {
+		ch <- s3ResolvedPrefix
+	}
 	if e.delimiter == "" {
 		ch <- s3LastModifiedObjectDate
 		ch <- s3LastModifiedObjectSize
 		ch <- s3ObjectTotal
 		ch <- s3SumSize
 		ch <- s3BiggestSize
+		if e.storageClasses() {
+			ch <- s3StorageClassObjects
+			ch <- s3StorageClassSize
+		}
+		if e.module.Prober == "inventory" {
+			ch <- s3InventoryCreationDate
+		}
+		if e.expect.set() {
+			ch <- s3FreshnessOK
+		}
+		if e.expect.MaxAge > 0 {
+			ch <- s3ExpectedMaxAge
+		}
+		if e.state != nil {
+			e.describeState(ch)
+		}
+		if e.module.Incremental != nil {
+			ch <- s3ListIncremental
+			ch <- s3LastFullListDate
+		}
 	} else {
 		ch <- s3CommonPrefixes
 	}
@@ -90,101 +207,299 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 
 // Collect metrics
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	var lastModified time.Time
-	var numberOfObjects float64
-	var totalSize int64
-	var biggestObjectSize int64
-	var lastObjectSize int64
-	var commonPrefixes int
-
-	query := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(e.bucket),
-		Prefix:    aws.String(e.prefix),
-		Delimiter: aws.String(e.delimiter),
-	}
-
-	// Continue making requests until we've listed and compared the date of every object
-	startList := time.Now()
-	for {
-		resp, err := e.svc.ListObjectsV2(query)
-		if err != nil {
-			log.Errorln(err)
-			ch <- prometheus.MustNewConstMetric(
-				s3ListSuccess, prometheus.GaugeValue, 0, e.bucket, e.prefix,
-			)
-			return
-		}
-		commonPrefixes = commonPrefixes + len(resp.CommonPrefixes)
-		for _, item := range resp.Contents {
-			numberOfObjects++
-			totalSize = totalSize + *item.Size
-			if item.LastModified.After(lastModified) {
-				lastModified = *item.LastModified
-				lastObjectSize = *item.Size
-			}
-			if *item.Size > biggestObjectSize {
-				biggestObjectSize = *item.Size
-			}
-		}
-		if resp.NextContinuationToken == nil {
-			break
-		}
-		query.ContinuationToken = resp.NextContinuationToken
+	switch e.module.Prober {
+	case "head":
+		e.collectHead(ch)
+		return
+	case "content":
+		e.collectContent(ch)
+		return
+	case "json":
+		e.collectJSON(ch)
+		return
+	case "compare":
+		e.collectCompare(ch)
+		return
+	case "cloudwatch":
+		e.collectCloudWatch(ch)
+		return
+	case "accesslog":
+		e.collectAccessLog(ch)
+		return
+	case "cloudtrail":
+		e.collectCloudTrail(ch)
+		return
+	case "textfile":
+		e.collectTextfiles(ch)
+		return
+	}
+
+	if e.prefix != e.prefixLabel {
+		ch <- prometheus.MustNewConstMetric(
+			s3ResolvedPrefix, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel, e.prefix,
+		)
+	}
+
+	o := e.probe()
+	if o.err != nil {
+		log.Errorln(o.err)
+		ch <- prometheus.MustNewConstMetric(
+			s3ListSuccess, prometheus.GaugeValue, 0, e.bucket, e.prefixLabel, e.delimiter,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			s3ListFailure, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel, e.delimiter, o.reason,
+		)
+		e.collectExpectations(ch, nil)
+		return
 	}
-	listDuration := time.Now().Sub(startList).Seconds()
+	result := o.result
 
 	ch <- prometheus.MustNewConstMetric(
-		s3ListSuccess, prometheus.GaugeValue, 1, e.bucket, e.prefix, e.delimiter,
+		s3ListSuccess, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel, e.delimiter,
 	)
 	ch <- prometheus.MustNewConstMetric(
-		s3ListDuration, prometheus.GaugeValue, listDuration, e.bucket, e.prefix, e.delimiter,
+		s3ListDuration, prometheus.GaugeValue, o.duration.Seconds(), e.bucket, e.prefixLabel, e.delimiter,
+	)
+	truncated := 0.0
+	if result.truncated {
+		truncated = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		s3ListTruncated, prometheus.GaugeValue, truncated, e.bucket, e.prefixLabel, e.delimiter,
 	)
 	if e.delimiter == "" {
 		ch <- prometheus.MustNewConstMetric(
-			s3LastModifiedObjectDate, prometheus.GaugeValue, float64(lastModified.UnixNano()/1e9), e.bucket, e.prefix,
+			s3LastModifiedObjectDate, prometheus.GaugeValue, float64(result.lastModified.UnixNano()/1e9), e.bucket, e.prefixLabel,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			s3LastModifiedObjectSize, prometheus.GaugeValue, float64(lastObjectSize), e.bucket, e.prefix,
+			s3LastModifiedObjectSize, prometheus.GaugeValue, float64(result.lastObjectSize), e.bucket, e.prefixLabel,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			s3ObjectTotal, prometheus.GaugeValue, numberOfObjects, e.bucket, e.prefix,
+			s3ObjectTotal, prometheus.GaugeValue, float64(result.objects), e.bucket, e.prefixLabel,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			s3BiggestSize, prometheus.GaugeValue, float64(biggestObjectSize), e.bucket, e.prefix,
+			s3BiggestSize, prometheus.GaugeValue, float64(result.biggestSize), e.bucket, e.prefixLabel,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			s3SumSize, prometheus.GaugeValue, float64(totalSize), e.bucket, e.prefix,
+			s3SumSize, prometheus.GaugeValue, float64(result.totalSize), e.bucket, e.prefixLabel,
 		)
+		if e.storageClasses() {
+			for class, t := range result.storageClasses {
+				ch <- prometheus.MustNewConstMetric(
+					s3StorageClassObjects, prometheus.GaugeValue, float64(t.objects), e.bucket, e.prefixLabel, class,
+				)
+				ch <- prometheus.MustNewConstMetric(
+					s3StorageClassSize, prometheus.GaugeValue, float64(t.totalSize), e.bucket, e.prefixLabel, class,
+				)
+			}
+		}
+		if e.module.Prober == "inventory" {
+			ch <- prometheus.MustNewConstMetric(
+				s3InventoryCreationDate, prometheus.GaugeValue, float64(result.inventoryCreated.Unix()), e.bucket, e.prefixLabel,
+			)
+		}
+		e.collectExpectations(ch, result)
+		if e.state != nil {
+			e.collectState(ch, result)
+		}
+		if e.module.Incremental != nil {
+			e.collectIncremental(ch, result)
+		}
 	} else {
 		ch <- prometheus.MustNewConstMetric(
-			s3CommonPrefixes, prometheus.GaugeValue, float64(commonPrefixes), e.bucket, e.prefix, e.delimiter,
+			s3CommonPrefixes, prometheus.GaugeValue, float64(result.commonPrefixes), e.bucket, e.prefixLabel, e.delimiter,
 		)
 	}
 }
 
-func probeHandler(w http.ResponseWriter, r *http.Request, svc s3iface.S3API) {
-	bucket := r.URL.Query().Get("bucket")
-	if bucket == "" {
-		http.Error(w, "bucket parameter is missing", http.StatusBadRequest)
+// probeOutcome is what listing the prefix found, or why it couldn't
+type probeOutcome struct {
+	result   *listResult
+	duration time.Duration
+	err      error
+	// reason the listing failed, either "timeout" or "error"
+	reason string
+}
+
+// probe lists the prefix, for Collect and the JSON API alike
+func (e *Exporter) probe() probeOutcome {
+	start := time.Now()
+	result, err := e.list()
+	observeProbe(e.moduleName, start, err == nil)
+
+	o := probeOutcome{result: result, duration: time.Since(start), err: err}
+	if err != nil {
+		o.reason = "error"
+		if e.ctx.Err() == context.DeadlineExceeded {
+			o.reason = "timeout"
+		}
+	}
+	return o
+}
+
+// collectExpectations reports whether the result of a listing met the
+// expectations set for the probe. A failed listing, with a nil result, never
+// does.
+func (e *Exporter) collectExpectations(ch chan<- prometheus.Metric, result *listResult) {
+	if !e.expect.set() || e.delimiter != "" {
 		return
 	}
+	ok := 0.0
+	if result != nil && e.expect.met(result, time.Now()) {
+		ok = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		s3FreshnessOK, prometheus.GaugeValue, ok, e.bucket, e.prefixLabel,
+	)
+	if e.expect.MaxAge > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			s3ExpectedMaxAge, prometheus.GaugeValue, time.Duration(e.expect.MaxAge).Seconds(), e.bucket, e.prefixLabel,
+		)
+	}
+}
 
-	prefix := r.URL.Query().Get("prefix")
-	delimiter := r.URL.Query().Get("delimiter")
+// getTimeout works out how long a probe may run for from the scrape timeout
+// Prometheus sends along with the request, leaving offset spare so the
+// response makes it back before Prometheus gives up
+func getTimeout(r *http.Request, offset time.Duration) (time.Duration, error) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse timeout from Prometheus header: %s", err)
+	}
+	timeout := time.Duration(seconds*float64(time.Second)) - offset
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout offset %s leaves no time for a scrape timeout of %ss", offset, v)
+	}
+	return timeout, nil
+}
+
+func probeHandler(w http.ResponseWriter, r *http.Request, svc s3iface.S3API, conf *Config, limiter *probeLimiter, timeoutOffset time.Duration) {
+	runProbe(w, r, svc, conf, limiter, timeoutOffset, func(exporter *Exporter) {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(exporter)
 
-	exporter := &Exporter{
-		bucket:    bucket,
-		prefix:    prefix,
-		delimiter: delimiter,
-		svc:       svc,
+		// Serve
+		h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+		h.ServeHTTP(w, r)
+	})
+}
+
+// runProbe sets up an exporter from the parameters of a probe request and
+// hands it to serve, once the probe has a slot to run in. Bad requests are
+// answered here and never reach serve.
+func runProbe(w http.ResponseWriter, r *http.Request, svc s3iface.S3API, conf *Config, limiter *probeLimiter, timeoutOffset time.Duration, serve func(*Exporter)) {
+	exporter, err := newExporter(r.URL.Query(), svc, conf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	registry := prometheus.NewRegistry()
-	registry.MustRegister(exporter)
+	timeout, err := getTimeout(r, timeoutOffset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	exporter.ctx = ctx
+
+	release, err := limiter.acquire(ctx, exporter.bucket)
+	if err != nil {
+		log.Warnln(err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
 
-	// Serve
-	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
-	h.ServeHTTP(w, r)
+	serve(exporter)
+}
+
+// newExporter sets up an exporter from the parameters of a probe. The
+// caller sets the context the probe runs in.
+func newExporter(params url.Values, svc s3iface.S3API, conf *Config) (*Exporter, error) {
+	bucket := params.Get("bucket")
+	if bucket == "" {
+		return nil, errors.New("bucket parameter is missing")
+	}
+
+	moduleName := params.Get("module")
+	if moduleName == "" {
+		moduleName = defaultModule
+	}
+	module, ok := conf.Modules[moduleName]
+	if !ok {
+		return nil, fmt.Errorf("unknown module %q", moduleName)
+	}
+
+	expect, err := module.Expectations.withParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixLabel := params.Get("prefix")
+	delimiter := params.Get("delimiter")
+	keyLabel := params.Get("key")
+	if (module.Prober == "head" || module.Prober == "content" || module.Prober == "json") && keyLabel == "" {
+		return nil, errors.New("key parameter is missing")
+	}
+	if module.Prober == "cloudwatch" && (prefixLabel != "" || delimiter != "") {
+		return nil, errors.New("the cloudwatch prober only covers whole buckets, without a prefix or delimiter")
+	}
+	if (module.Prober == "accesslog" || module.Prober == "cloudtrail") && delimiter != "" {
+		return nil, fmt.Errorf("the %s prober doesn't support a delimiter", module.Prober)
+	}
+
+	offset := module.PrefixOffset
+	if v := params.Get("prefix_offset"); v != "" {
+		offset, err = model.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix_offset parameter: %s", err)
+		}
+	}
+	now := time.Now().Add(-time.Duration(offset))
+	prefix, err := renderTemplate(prefixLabel, now)
+	if err != nil {
+		return nil, fmt.Errorf("error evaluating prefix template: %s", err)
+	}
+	key, err := renderTemplate(keyLabel, now)
+	if err != nil {
+		return nil, fmt.Errorf("error evaluating key template: %s", err)
+	}
+
+	e := &Exporter{
+		ctx:         context.Background(),
+		bucket:      bucket,
+		prefix:      prefix,
+		prefixLabel: prefixLabel,
+		delimiter:   delimiter,
+		key:         key,
+		keyLabel:    keyLabel,
+		moduleName:  moduleName,
+		module:      module,
+		expect:      expect,
+		lister:      module.newLister(svc),
+	}
+	if module.State != nil && delimiter == "" {
+		client := svc
+		if module.client != nil {
+			client = module.client
+		}
+		e.state = module.State.newStore(client)
+	}
+	if module.Prober == "compare" {
+		if err := e.setupCompare(params, svc, conf, now); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
 }
 
 type discoveryTarget struct {
@@ -225,49 +540,142 @@ func discoveryHandler(w http.ResponseWriter, r *http.Request, svc s3iface.S3API)
 
 func init() {
 	prometheus.MustRegister(version.NewCollector(namespace + "_exporter"))
+	prometheus.MustRegister(probeQueueDepth)
+	prometheus.MustRegister(probeQueueWait)
+	prometheus.MustRegister(probeRejections)
+	prometheus.MustRegister(apiRateLimitWait)
+	prometheus.MustRegister(apiRequests)
+	prometheus.MustRegister(apiRequestDuration)
+	prometheus.MustRegister(apiRetries)
+	prometheus.MustRegister(apiThrottles)
+	prometheus.MustRegister(probeDuration)
+	prometheus.MustRegister(probes)
 }
 
 func main() {
 	var (
 		app            = kingpin.New(namespace+"_exporter", "Export metrics for S3 certificates").DefaultEnvars()
+		configFile     = app.Flag("config.file", "Path to the configuration file, which defines the modules probes can use").Default("").String()
 		listenAddress  = app.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9340").String()
 		metricsPath    = app.Flag("web.metrics-path", "Path under which to expose metrics").Default("/metrics").String()
 		probePath      = app.Flag("web.probe-path", "Path under which to expose the probe endpoint").Default("/probe").String()
 		discoveryPath  = app.Flag("web.discovery-path", "Path under which to expose service discovery").Default("/discovery").String()
+		apiPath        = app.Flag("web.api-path", "Path under which to expose the JSON API for probes").Default("/api/v1/probe").String()
 		endpointURL    = app.Flag("s3.endpoint-url", "Custom endpoint URL").Default("").String()
 		disableSSL     = app.Flag("s3.disable-ssl", "Custom disable SSL").Bool()
 		forcePathStyle = app.Flag("s3.force-path-style", "Custom force path style").Bool()
+		requestsPerSec = app.Flag("s3.requests-per-second", "Maximum rate of S3 API requests, 0 means unlimited").Default("0").Float64()
+		requestsBurst  = app.Flag("s3.requests-burst", "Number of S3 API requests that can be made at once before the rate limit applies").Default("1").Int()
+		maxConcurrent  = app.Flag("probe.max-concurrent", "Maximum number of probes running at once, 0 means unlimited").Default("0").Int()
+		maxPerBucket   = app.Flag("probe.max-concurrent-per-bucket", "Maximum number of probes running at once against a single bucket, 0 means unlimited").Default("0").Int()
+		queueTimeout   = app.Flag("probe.queue-timeout", "How long a probe waits for a free slot before it is rejected").Default("30s").Duration()
+		timeoutOffset  = app.Flag("web.timeout-offset", "How much to take off the Prometheus scrape timeout to allow for the response to get back in time").Default("500ms").Duration()
+		memoryTargets  = app.Flag("state.memory-max-targets", "Maximum number of targets whose state is kept in memory, for modules without state, 0 means unlimited").Default(strconv.Itoa(defaultMemoryStateTargets)).Int()
+
+		serveCmd = app.Command("serve", "Run the exporter's web server").Default()
+		checkCmd = app.Command("check-config", "Check that the file given by --config.file is valid")
+
+		probeCmd          = app.Command("probe", "Probe a bucket once and print the result, exiting with 1 if the probe fails")
+		probeBucket       = probeCmd.Flag("bucket", "Bucket to probe").Required().String()
+		probePrefix       = probeCmd.Flag("prefix", "Prefix to probe, which can be a template").String()
+		probeDelimiter    = probeCmd.Flag("delimiter", "Delimiter to count common prefixes with").String()
+		probeKey          = probeCmd.Flag("key", "Key to probe, for probers that check a single object").String()
+		probeModule       = probeCmd.Flag("module", "Module to probe with").Default(defaultModule).String()
+		probeDestBucket   = probeCmd.Flag("destination-bucket", "Bucket to compare with, for the compare prober").String()
+		probeDestPrefix   = probeCmd.Flag("destination-prefix", "Prefix to compare with, for the compare prober, which can be a template").String()
+		probeDestModule   = probeCmd.Flag("destination-module", "Module to read the destination with, for the compare prober").String()
+		probeMaxAge       = probeCmd.Flag("max-age", "Override the max_age expected by the module").String()
+		probeMinObjects   = probeCmd.Flag("min-objects", "Override the min_objects expected by the module").String()
+		probeMinSize      = probeCmd.Flag("min-size", "Override the min_size expected by the module").String()
+		probePrefixOffset = probeCmd.Flag("prefix-offset", "Override the prefix_offset of the module").String()
+		probeOutput       = probeCmd.Flag("output", "Output format").Default("text").Enum("text", "json")
+		probeTimeout      = probeCmd.Flag("timeout", "How long the probe can take, 0 means no limit").Default("5m").Duration()
 	)
 
 	log.AddFlags(app)
 	app.Version(version.Print(namespace + "_exporter"))
 	app.HelpFlag.Short('h')
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	if command == checkCmd.FullCommand() {
+		os.Exit(checkConfigCommand(os.Stdout, *configFile))
+	}
 
-	var sess *session.Session
-	var err error
+	memoryState = newMemStateStore(*memoryTargets)
+
+	conf := defaultConfig()
+	if *configFile != "" {
+		var err error
+		conf, err = loadConfig(*configFile)
+		if err != nil {
+			log.Fatalln("Error loading config", err)
+		}
+	}
 
-	sess, err = session.NewSession()
+	sess, err := session.NewSession()
 	if err != nil {
 		log.Errorln("Error creating sessions ", err)
 	}
 
-	cfg := aws.NewConfig()
-	if *endpointURL != "" {
-		cfg.WithEndpoint(*endpointURL)
+	var rateLimiter *rate.Limiter
+	if *requestsPerSec > 0 {
+		rateLimiter = rate.NewLimiter(rate.Limit(*requestsPerSec), *requestsBurst)
 	}
+	s3Config := S3Config{
+		EndpointURL:    *endpointURL,
+		DisableSSL:     *disableSSL,
+		ForcePathStyle: *forcePathStyle,
+	}
+	svc := newS3Client(sess, s3Config, rateLimiter)
+	conf.setupClients(sess, s3Config, rateLimiter)
 
-	cfg.WithDisableSSL(*disableSSL)
-	cfg.WithS3ForcePathStyle(*forcePathStyle)
+	if command == probeCmd.FullCommand() {
+		params := url.Values{}
+		for name, v := range map[string]string{
+			"bucket":             *probeBucket,
+			"prefix":             *probePrefix,
+			"delimiter":          *probeDelimiter,
+			"key":                *probeKey,
+			"module":             *probeModule,
+			"destination_bucket": *probeDestBucket,
+			"destination_prefix": *probeDestPrefix,
+			"destination_module": *probeDestModule,
+			"max_age":            *probeMaxAge,
+			"min_objects":        *probeMinObjects,
+			"min_size":           *probeMinSize,
+			"prefix_offset":      *probePrefixOffset,
+		} {
+			if v != "" {
+				params.Set(name, v)
+			}
+		}
+		ctx := context.Background()
+		if *probeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *probeTimeout)
+			defer cancel()
+		}
+		code := probeCommand(ctx, os.Stdout, params, svc, conf, *probeOutput)
+		if code != exitOK {
+			os.Exit(code)
+		}
+		return
+	}
+	if command != serveCmd.FullCommand() {
+		log.Fatalln("Unknown command", command)
+	}
 
-	svc := s3.New(sess, cfg)
+	limiter := newProbeLimiter(*maxConcurrent, *maxPerBucket, *queueTimeout)
 
 	log.Infoln("Starting "+namespace+"_exporter", version.Info())
 	log.Infoln("Build context", version.BuildContext())
 
 	http.Handle(*metricsPath, promhttp.Handler())
 	http.HandleFunc(*probePath, func(w http.ResponseWriter, r *http.Request) {
-		probeHandler(w, r, svc)
+		probeHandler(w, r, svc, conf, limiter, *timeoutOffset)
+	})
+	http.HandleFunc(*apiPath, func(w http.ResponseWriter, r *http.Request) {
+		apiProbeHandler(w, r, svc, conf, limiter, *timeoutOffset)
 	})
 	http.HandleFunc(*discoveryPath, func(w http.ResponseWriter, r *http.Request) {
 		discoveryHandler(w, r, svc)
@@ -278,6 +686,7 @@ func main() {
 						 <body>
 						 <h1>AWS S3 Exporter</h1>
 						 <p><a href="` + *probePath + `?bucket=BUCKET&prefix=PREFIX">Query metrics for objects in BUCKET that match PREFIX</a></p>
+						 <p><a href="` + *apiPath + `?bucket=BUCKET&prefix=PREFIX">Query the same as JSON</a></p>
 						 <p><a href='` + *metricsPath + `'>Metrics</a></p>
 						 <p><a href='` + *discoveryPath + `'>Service Discovery</a></p>
 						 </body>
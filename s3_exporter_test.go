@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
@@ -23,6 +25,7 @@ var (
 			Prefix: "one",
 			ExpectedOutputLines: []string{
 				"s3_list_success{bucket=\"mock\",delimiter=\"\",prefix=\"one\"} 1",
+				"s3_list_truncated{bucket=\"mock\",delimiter=\"\",prefix=\"one\"} 0",
 				"s3_last_modified_object_date{bucket=\"mock\",prefix=\"one\"} 1.5604596e+09",
 				"s3_last_modified_object_size_bytes{bucket=\"mock\",prefix=\"one\"} 1234",
 				"s3_biggest_object_size_bytes{bucket=\"mock\",prefix=\"one\"} 1234",
@@ -186,14 +189,69 @@ func TestProbeHandler(t *testing.T) {
 	}
 }
 
-// ListObjectsV2 mocks out the corresponding function in the S3 client, returning the response that corresponds to the test case
-func (m *mockS3Client) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+// TestProbeHandlerTimeout checks that a probe gives up when the scrape timeout
+// sent by Prometheus runs out
+func TestProbeHandlerTimeout(t *testing.T) {
+	req, err := http.NewRequest("GET", "/probe?bucket=mock&prefix=hang", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.05")
+
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, mockSvc, defaultConfig(), nil, 0)
+
+	expected := []string{
+		"s3_list_success{bucket=\"mock\",delimiter=\"\",prefix=\"hang\"} 0",
+		"s3_list_failure{bucket=\"mock\",delimiter=\"\",prefix=\"hang\",reason=\"timeout\"} 1",
+	}
+	for _, l := range expected {
+		if !strings.Contains(rr.Body.String(), l) {
+			t.Errorf("expected " + l)
+		}
+	}
+}
+
+// TestGetTimeout checks the offset is taken off the scrape timeout
+func TestGetTimeout(t *testing.T) {
+	req, err := http.NewRequest("GET", "/probe?bucket=mock", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout, err := getTimeout(req, 500*time.Millisecond)
+	if err != nil || timeout != 0 {
+		t.Errorf("expected no timeout without the header, got %s, %v", timeout, err)
+	}
+
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+	timeout, err = getTimeout(req, 500*time.Millisecond)
+	if err != nil || timeout != 9500*time.Millisecond {
+		t.Errorf("expected a timeout of 9.5s, got %s, %v", timeout, err)
+	}
+
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.1")
+	if _, err = getTimeout(req, 500*time.Millisecond); err == nil {
+		t.Errorf("expected an error when the offset is bigger than the timeout")
+	}
+}
+
+// ListObjectsV2PagesWithContext mocks out the corresponding function in the S3 client, returning the response that corresponds to the test case
+func (m *mockS3Client) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	// Simulate a listing that never finishes
+	if *input.Prefix == "hang" {
+		<-ctx.Done()
+		return awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+	}
+
 	r, err := testCases.response(*input.Bucket, *input.Prefix)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return r, nil
+	fn(r, true)
+
+	return nil
 }
 
 // Repeatable probe function
@@ -212,7 +270,7 @@ func probe(bucket, prefix, delimiter string) (rr *httptest.ResponseRecorder, err
 
 	rr = httptest.NewRecorder()
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		probeHandler(w, r, mockSvc)
+		probeHandler(w, r, mockSvc, defaultConfig(), nil, 0)
 	})
 
 	handler.ServeHTTP(rr, req)
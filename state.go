@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	s3ObjectsAdded = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "objects_added_total"),
+		"The number of objects found under the prefix that weren't there on the probe before",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3ObjectsRemoved = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "objects_removed_total"),
+		"The number of objects that were under the prefix on the probe before and no longer are",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3ObjectsAddedBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "objects_added_bytes_total"),
+		"The total size of the objects that were added",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3ObjectsChurn = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "objects_churn_ratio"),
+		"The number of objects added and removed since the probe before, as a fraction of the objects there were then",
+		[]string{"bucket", "prefix"}, nil,
+	)
+	s3StateSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "state_success"),
+		"If the state kept from the probe before was loaded and the new state saved",
+		[]string{"bucket", "prefix"}, nil,
+	)
+)
+
+// StateConfig is where the listing of each target is kept between probes, so
+// that they can be compared. It's either a directory or a bucket, with a file
+// or object for each target.
+type StateConfig struct {
+	Directory string `yaml:"directory,omitempty"`
+	Bucket    string `yaml:"bucket,omitempty"`
+	Prefix    string `yaml:"prefix,omitempty"`
+}
+
+// UnmarshalYAML validates a state config
+func (s *StateConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain StateConfig
+	if err := value.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	if (s.Directory == "") == (s.Bucket == "") {
+		return fmt.Errorf("line %d: state must have one of directory or bucket", value.Line)
+	}
+	if s.Prefix != "" && s.Bucket == "" {
+		return fmt.Errorf("line %d: state prefix is only used with a bucket", value.Line)
+	}
+	return nil
+}
+
+// stateStore saves and loads the state of each target
+type stateStore interface {
+	// load returns nil if there's no state saved for the target
+	load(ctx context.Context, id string) ([]byte, error)
+	save(ctx context.Context, id string, b []byte) error
+}
+
+// newStore returns the store for the config, using svc for a bucket
+func (s *StateConfig) newStore(svc s3iface.S3API) stateStore {
+	if s.Directory != "" {
+		return &fileStateStore{dir: s.Directory}
+	}
+	return &s3StateStore{svc: svc, bucket: s.Bucket, prefix: s.Prefix}
+}
+
+// fileStateStore keeps state in files in a directory
+type fileStateStore struct {
+	dir string
+}
+
+func (s *fileStateStore) load(ctx context.Context, id string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// save writes to a temporary file first so that a crash can't leave half of
+// a file behind
+func (s *fileStateStore) save(ctx context.Context, id string, b []byte) error {
+	f, err := ioutil.TempFile(s.dir, id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, id+".json"))
+}
+
+// s3StateStore keeps state in objects in a bucket
+type s3StateStore struct {
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+}
+
+func (s *s3StateStore) load(ctx context.Context, id string) ([]byte, error) {
+	resp, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + id + ".json"),
+	})
+	if errors.Is(s3Error(err), errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *s3StateStore) save(ctx context.Context, id string, b []byte) error {
+	_, err := s.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.prefix + id + ".json"),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// objectDigest stands in for an object in the state. The key is hashed to
+// keep the state small.
+type objectDigest struct {
+	hash uint64
+	size int64
+}
+
+// digestObject returns the digest of an object
+func digestObject(o *objectInfo) objectDigest {
+	h := fnv.New64a()
+	h.Write([]byte(o.Key))
+	return objectDigest{hash: h.Sum64(), size: o.Size}
+}
+
+// probeState is what's kept for a target between probes
+type probeState struct {
+	Time time.Time `json:"time"`
+	// ResolvedPrefix is the prefix that was listed. When it changes, with
+	// a date template in the prefix, the listings aren't compared.
+	ResolvedPrefix string  `json:"resolved_prefix"`
+	Objects        int64   `json:"objects"`
+	Added          float64 `json:"objects_added"`
+	Removed        float64 `json:"objects_removed"`
+	AddedBytes     float64 `json:"objects_added_bytes"`
+	// Digests has 16 bytes for each object, sorted: the hash of its key and
+	// then its size
+	Digests []byte `json:"digests"`
+}
+
+// encodeDigests sorts the digests and packs them into bytes
+func encodeDigests(digests []objectDigest) []byte {
+	sort.Slice(digests, func(i, j int) bool { return digests[i].hash < digests[j].hash })
+	b := make([]byte, 16*len(digests))
+	for i, d := range digests {
+		binary.BigEndian.PutUint64(b[16*i:], d.hash)
+		binary.BigEndian.PutUint64(b[16*i+8:], uint64(d.size))
+	}
+	return b
+}
+
+// decodeDigests unpacks digests packed by encodeDigests
+func decodeDigests(b []byte) []objectDigest {
+	digests := make([]objectDigest, 0, len(b)/16)
+	for ; len(b) >= 16; b = b[16:] {
+		digests = append(digests, objectDigest{
+			hash: binary.BigEndian.Uint64(b),
+			size: int64(binary.BigEndian.Uint64(b[8:])),
+		})
+	}
+	return digests
+}
+
+// diffDigests compares two sets of encoded digests and returns the number of
+// objects in b that aren't in a, their total size, and the number of objects
+// in a that aren't in b
+func diffDigests(a, b []byte) (added, addedBytes, removed int64) {
+	for len(a) > 0 || len(b) > 0 {
+		var ha, hb uint64
+		if len(a) > 0 {
+			ha = binary.BigEndian.Uint64(a)
+		}
+		if len(b) > 0 {
+			hb = binary.BigEndian.Uint64(b)
+		}
+		switch {
+		case len(b) == 0 || (len(a) > 0 && ha < hb):
+			removed++
+			a = a[16:]
+		case len(a) == 0 || hb < ha:
+			added++
+			addedBytes = addedBytes + int64(binary.BigEndian.Uint64(b[8:]))
+			b = b[16:]
+		default:
+			a, b = a[16:], b[16:]
+		}
+	}
+	return added, addedBytes, removed
+}
+
+// stateLocks stops probes of the same target updating its state at the same
+// time
+var stateLocks = struct {
+	sync.Mutex
+	m map[string]*stateLock
+}{m: map[string]*stateLock{}}
+
+// stateLock is the lock for one state, along with the number of probes
+// holding or waiting for it. It's dropped once there are none.
+type stateLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockState locks the state with id and returns a function that unlocks it
+func lockState(id string) func() {
+	stateLocks.Lock()
+	l, ok := stateLocks.m[id]
+	if !ok {
+		l = &stateLock{}
+		stateLocks.m[id] = l
+	}
+	l.refs++
+	stateLocks.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		stateLocks.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(stateLocks.m, id)
+		}
+		stateLocks.Unlock()
+	}
+}
+
+// stateID names the state for the exporter's target. It's the same for
+// every probe of the same module, bucket and prefix parameter.
+func (e *Exporter) stateID() string {
+	h := sha256.Sum256([]byte(e.moduleName + "\x00" + e.bucket + "\x00" + e.prefixLabel))
+	return hex.EncodeToString(h[:16])
+}
+
+// updateState compares the result of a listing with the state saved by the
+// probe before, adds the difference to the counters and saves the new state.
+// It returns the new state and the churn since the probe before, which is
+// negative when there was nothing to compare with.
+func (e *Exporter) updateState(result *listResult) (*probeState, float64, error) {
+	id := e.stateID()
+	defer lockState(id)()
+
+	next := &probeState{
+		Time:           time.Now(),
+		ResolvedPrefix: e.prefix,
+		Objects:        result.objects,
+		Digests:        encodeDigests(result.digests),
+	}
+	churn := -1.0
+	b, err := e.state.load(e.ctx, id)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error loading state: %s", err)
+	}
+	if b != nil {
+		prev := &probeState{}
+		if err := json.Unmarshal(b, prev); err != nil {
+			return nil, 0, fmt.Errorf("error decoding state: %s", err)
+		}
+		next.Added = prev.Added
+		next.Removed = prev.Removed
+		next.AddedBytes = prev.AddedBytes
+		if prev.ResolvedPrefix == e.prefix {
+			added, addedBytes, removed := diffDigests(prev.Digests, next.Digests)
+			next.Added = next.Added + float64(added)
+			next.Removed = next.Removed + float64(removed)
+			next.AddedBytes = next.AddedBytes + float64(addedBytes)
+			if prev.Objects > 0 {
+				churn = float64(added+removed) / float64(prev.Objects)
+			}
+		}
+	}
+
+	b, err = json.Marshal(next)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := e.state.save(e.ctx, id, b); err != nil {
+		return nil, 0, fmt.Errorf("error saving state: %s", err)
+	}
+	return next, churn, nil
+}
+
+func (e *Exporter) describeState(ch chan<- *prometheus.Desc) {
+	ch <- s3StateSuccess
+	ch <- s3ObjectsAdded
+	ch <- s3ObjectsRemoved
+	ch <- s3ObjectsAddedBytes
+	ch <- s3ObjectsChurn
+}
+
+// collectState reports the changes since the probe before. A truncated
+// listing isn't saved, as it would look like most of the objects had been
+// removed.
+func (e *Exporter) collectState(ch chan<- prometheus.Metric, result *listResult) {
+	if result.truncated {
+		return
+	}
+	s, churn, err := e.updateState(result)
+	if err != nil {
+		log.Errorln(err)
+		ch <- prometheus.MustNewConstMetric(
+			s3StateSuccess, prometheus.GaugeValue, 0, e.bucket, e.prefixLabel,
+		)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		s3StateSuccess, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3ObjectsAdded, prometheus.CounterValue, s.Added, e.bucket, e.prefixLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3ObjectsRemoved, prometheus.CounterValue, s.Removed, e.bucket, e.prefixLabel,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3ObjectsAddedBytes, prometheus.CounterValue, s.AddedBytes, e.bucket, e.prefixLabel,
+	)
+	if churn >= 0 {
+		ch <- prometheus.MustNewConstMetric(
+			s3ObjectsChurn, prometheus.GaugeValue, churn, e.bucket, e.prefixLabel,
+		)
+	}
+}
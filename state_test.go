@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// TestDiffDigests checks that objects are matched up by their keys
+func TestDiffDigests(t *testing.T) {
+	digests := func(objects ...objectInfo) []byte {
+		var d []objectDigest
+		for i := range objects {
+			d = append(d, digestObject(&objects[i]))
+		}
+		return encodeDigests(d)
+	}
+	a := digests(objectInfo{Key: "a", Size: 1}, objectInfo{Key: "b", Size: 2}, objectInfo{Key: "c", Size: 3})
+	b := digests(objectInfo{Key: "c", Size: 30}, objectInfo{Key: "d", Size: 4}, objectInfo{Key: "e", Size: 5}, objectInfo{Key: "a", Size: 1})
+
+	added, addedBytes, removed := diffDigests(a, b)
+	if added != 2 || addedBytes != 9 || removed != 1 {
+		t.Errorf("expected 2 objects of 9 bytes added and 1 removed, got %d of %d and %d", added, addedBytes, removed)
+	}
+	if added, _, removed := diffDigests(nil, b); added != 4 || removed != 0 {
+		t.Errorf("expected every object to be added, got %d and %d", added, removed)
+	}
+	if added, _, removed := diffDigests(a, a); added != 0 || removed != 0 {
+		t.Errorf("expected no change, got %d and %d", added, removed)
+	}
+}
+
+// TestLockState checks that probes of the same target take turns, and that
+// the locks of targets without probes aren't kept
+func TestLockState(t *testing.T) {
+	var wg sync.WaitGroup
+	n := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer lockState("a")()
+			n++
+		}()
+	}
+	wg.Wait()
+	if n != 10 {
+		t.Errorf("expected 10 updates, got %d", n)
+	}
+
+	stateLocks.Lock()
+	defer stateLocks.Unlock()
+	if len(stateLocks.m) != 0 {
+		t.Errorf("expected every lock to be dropped once unlocked, got %d", len(stateLocks.m))
+	}
+}
+
+// TestProbeHandlerState checks the counters over a series of probes, with
+// state in a directory and in a bucket
+func TestProbeHandlerState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf, err := parseConfig([]byte(`
+modules:
+  file:
+    state:
+      directory: ` + dir + `
+  bucket:
+    state:
+      bucket: state
+      prefix: s3_exporter/
+  budget:
+    max_objects: 2
+    state:
+      directory: ` + dir + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects := func(keys ...string) []*s3.Object {
+		var objects []*s3.Object
+		for _, k := range keys {
+			objects = append(objects, &s3.Object{
+				Key:          aws.String(k),
+				Size:         aws.Int64(int64(len(k))),
+				LastModified: aws.Time(time.Now()),
+			})
+		}
+		return objects
+	}
+	labels := `{bucket="mock",prefix="data/"}`
+	// What the first probe reports is in the state golden test
+	steps := []struct {
+		objects  []*s3.Object
+		expected []string
+	}{
+		{
+			objects: objects("data/a", "data/b", "data/c", "data/d"),
+		},
+		{
+			objects: objects("data/a", "data/c", "data/d", "data/ee", "data/fff"),
+			expected: []string{
+				"s3_objects_added_total" + labels + " 2",
+				"s3_objects_removed_total" + labels + " 1",
+				"s3_objects_added_bytes_total" + labels + " 15",
+				"s3_objects_churn_ratio" + labels + " 0.75",
+			},
+		},
+		{
+			objects: objects("data/a", "data/c", "data/d", "data/ee", "data/fff"),
+			expected: []string{
+				"s3_objects_added_total" + labels + " 2",
+				"s3_objects_removed_total" + labels + " 1",
+				"s3_objects_churn_ratio" + labels + " 0",
+			},
+		},
+	}
+	for _, module := range []string{"file", "bucket"} {
+		svc := newMemS3Client(nil)
+		for i, step := range steps {
+			svc.objects = newMemS3Client(step.objects).objects
+			req, err := http.NewRequest("GET", "/probe?bucket=mock&prefix=data/&module="+module, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			probeHandler(rr, req, svc, conf, nil, 0)
+
+			for _, l := range step.expected {
+				if !strings.Contains(rr.Body.String(), l) {
+					t.Errorf("%s, probe %d: expected %s in:\n%s", module, i, l, rr.Body.String())
+				}
+			}
+		}
+		if module == "bucket" && len(svc.bodies) != 1 {
+			t.Errorf("expected the state to be saved to the bucket, got %d objects", len(svc.bodies))
+		}
+	}
+
+	// A truncated listing isn't compared or saved
+	svc := newMemS3Client(objects("data/a", "data/b", "data/c"))
+	req, err := http.NewRequest("GET", "/probe?bucket=mock&prefix=data/&module=budget", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, svc, conf, nil, 0)
+	if strings.Contains(rr.Body.String(), "s3_state_success") {
+		t.Errorf("didn't expect state for a truncated listing:\n%s", rr.Body.String())
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected a file for the state of the file module, got %d files", len(files))
+	}
+}
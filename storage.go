@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// errNotFound is returned, wrapped, by an ObjectLister when there's no such
+// object
+var errNotFound = errors.New("object not found")
+
+// ObjectLister is the storage that probes read from. S3 is the default, and
+// other backends present what they store the way S3 would, so that every
+// prober gives the same answers whatever the storage.
+type ObjectLister interface {
+	// ListPages lists the objects under a prefix in key order, a page at a
+	// time, with the keys that have the delimiter after the prefix rolled up
+	// into common prefixes, as ListObjectsV2 does. fn is called for each page
+	// and returns false to stop.
+	ListPages(ctx context.Context, q listQuery, fn func(page *listPage, lastPage bool) bool) error
+	// Head returns an object's details without reading it
+	Head(ctx context.Context, bucket, key string) (*objectInfo, error)
+	// Get reads an object, or the range of it given in the format of an
+	// HTTP Range header
+	Get(ctx context.Context, bucket, key, byteRange string) (io.ReadCloser, error)
+}
+
+// listQuery is what to list. Only keys after StartAfter are listed, if it's
+// set, and pages have no more than MaxKeys objects and common prefixes
+// between them, if it's set.
+type listQuery struct {
+	Bucket     string
+	Prefix     string
+	Delimiter  string
+	StartAfter string
+	MaxKeys    int64
+}
+
+// listPage is a page of a listing
+type listPage struct {
+	Objects        []objectInfo
+	CommonPrefixes []string
+}
+
+// objectInfo describes an object. Backends leave empty what they don't
+// know.
+type objectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	StorageClass string
+	ETag         string
+	Metadata     map[string]string
+}
+
+// newLister returns the storage that probes with the module read from, which
+// is svc unless the module has its own S3 config or reads from local disk
+func (m Module) newLister(svc s3iface.S3API) ObjectLister {
+	if m.Filesystem != nil {
+		return &fsLister{root: m.Filesystem.Root}
+	}
+	if m.client != nil {
+		return &s3Lister{svc: m.client}
+	}
+	return &s3Lister{svc: svc}
+}
+
+// s3Lister reads from S3, or storage with an S3 compatible API
+type s3Lister struct {
+	svc s3iface.S3API
+}
+
+// ListPages lists the objects with ListObjectsV2
+func (l *s3Lister) ListPages(ctx context.Context, q listQuery, fn func(*listPage, bool) bool) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(q.Bucket),
+		Prefix: aws.String(q.Prefix),
+	}
+	if q.Delimiter != "" {
+		input.Delimiter = aws.String(q.Delimiter)
+	}
+	if q.StartAfter != "" {
+		input.StartAfter = aws.String(q.StartAfter)
+	}
+	if q.MaxKeys > 0 {
+		input.MaxKeys = aws.Int64(q.MaxKeys)
+	}
+	return l.svc.ListObjectsV2PagesWithContext(ctx, input, func(resp *s3.ListObjectsV2Output, lastPage bool) bool {
+		page := &listPage{}
+		for _, item := range resp.Contents {
+			page.Objects = append(page.Objects, objectInfo{
+				Key:          aws.StringValue(item.Key),
+				Size:         aws.Int64Value(item.Size),
+				LastModified: aws.TimeValue(item.LastModified),
+				StorageClass: aws.StringValue(item.StorageClass),
+				ETag:         aws.StringValue(item.ETag),
+			})
+		}
+		for _, cp := range resp.CommonPrefixes {
+			page.CommonPrefixes = append(page.CommonPrefixes, aws.StringValue(cp.Prefix))
+		}
+		return fn(page, lastPage)
+	})
+}
+
+// Head gets an object's details with HeadObject
+func (l *s3Lister) Head(ctx context.Context, bucket, key string) (*objectInfo, error) {
+	resp, err := l.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	info := &objectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(resp.ContentLength),
+		LastModified: aws.TimeValue(resp.LastModified),
+		StorageClass: aws.StringValue(resp.StorageClass),
+		ETag:         aws.StringValue(resp.ETag),
+	}
+	for k, v := range resp.Metadata {
+		if info.Metadata == nil {
+			info.Metadata = map[string]string{}
+		}
+		info.Metadata[k] = aws.StringValue(v)
+	}
+	return info, nil
+}
+
+// Get reads an object with GetObject
+func (l *s3Lister) Get(ctx context.Context, bucket, key, byteRange string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+	resp, err := l.svc.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return resp.Body, nil
+}
+
+// s3Error wraps errNotFound around the errors S3 returns for missing
+// objects. HEAD responses have no body, so there's only the status code to
+// go on for them.
+func s3Error(err error) error {
+	switch aerr := err.(type) {
+	case awserr.RequestFailure:
+		if aerr.StatusCode() == http.StatusNotFound && aerr.Code() != s3.ErrCodeNoSuchBucket {
+			return fmt.Errorf("%w: %s", errNotFound, err)
+		}
+	case awserr.Error:
+		if aerr.Code() == s3.ErrCodeNoSuchKey {
+			return fmt.Errorf("%w: %s", errNotFound, err)
+		}
+	}
+	return err
+}
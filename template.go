@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateData is what templates in prefixes are evaluated with. Now is the
+// time of the probe, in UTC, less any offset.
+type templateData struct {
+	Now          time.Time
+	Yesterday    time.Time
+	PreviousHour time.Time
+}
+
+var templateFuncs = template.FuncMap{
+	"strftime": strftime,
+}
+
+// parseTemplate parses text as a template for a prefix
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("prefix").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// renderTemplate evaluates text as a template at the time now. Text without
+// any actions is returned as it is.
+func renderTemplate(text string, now time.Time) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := parseTemplate(text)
+	if err != nil {
+		return "", err
+	}
+
+	now = now.UTC()
+	var b strings.Builder
+	err = t.Execute(&b, templateData{
+		Now:          now,
+		Yesterday:    now.AddDate(0, 0, -1),
+		PreviousHour: now.Add(-time.Hour),
+	})
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// strftime formats t with the common strftime conversions
+func strftime(format string, t time.Time) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return "", fmt.Errorf("strftime format %q ends with %%", format)
+		}
+		switch format[i] {
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'S':
+			b.WriteString(t.Format("05"))
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("unsupported strftime conversion %%%c in %q", format[i], format)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRenderTemplate checks the template data and functions available in
+// prefix templates
+func TestRenderTemplate(t *testing.T) {
+	now := time.Date(2026, time.October, 16, 0, 30, 0, 0, time.UTC)
+
+	tests := map[string]string{
+		"events/": "events/",
+		"100%/":   "100%/",
+		`events/dt={{ .Now.Format "2006-01-02" }}/`:                                                 "events/dt=2026-10-16/",
+		`events/dt={{ .Yesterday.Format "2006-01-02" }}/`:                                           "events/dt=2026-10-15/",
+		`events/dt={{ strftime "%Y-%m-%d" .PreviousHour }}/hour={{ strftime "%H" .PreviousHour }}/`: "events/dt=2026-10-15/hour=23/",
+		`{{ strftime "%y%j %% %s" .Now }}`:                                                          "26289 % 1792110600",
+	}
+	for text, expected := range tests {
+		got, err := renderTemplate(text, now)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", text, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("%s: expected %s, got %s", text, expected, got)
+		}
+	}
+
+	for _, text := range []string{`{{ .Now`, `{{ .Tomorrow }}`, `{{ strftime "%Q" .Now }}`} {
+		if _, err := renderTemplate(text, now); err == nil {
+			t.Errorf("%s: expected an error", text)
+		}
+	}
+}
+
+// TestProbeHandlerPrefixTemplate checks that the template is kept in the
+// prefix label and the prefix it resolved to is exposed
+func TestProbeHandlerPrefixTemplate(t *testing.T) {
+	svc := newMemS3Client(memObjects())
+	prefix := `{{ .Now.Format "data/" }}`
+
+	req, err := http.NewRequest("GET", "/probe?bucket=mock&prefix_offset=1d&prefix="+url.QueryEscape(prefix), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, svc, defaultConfig(), nil, 0)
+
+	expected := []string{
+		`s3_objects{bucket="mock",prefix="{{ .Now.Format \"data/\" }}"} 13`,
+		`s3_resolved_prefix_info{bucket="mock",prefix="{{ .Now.Format \"data/\" }}",resolved_prefix="data/"} 1`,
+	}
+	for _, l := range expected {
+		if !strings.Contains(rr.Body.String(), l) {
+			t.Errorf("expected %s", l)
+		}
+	}
+}
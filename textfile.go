@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	s3TextfileMtime = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "textfile", "mtime_seconds"),
+		"The last modified date of each text format file",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3TextfileStale = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "textfile", "stale"),
+		"If the file was skipped because it's older than stale_after",
+		[]string{"bucket", "key"}, nil,
+	)
+	s3TextfileError = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "textfile", "error"),
+		"If the file was skipped because it couldn't be read or its metrics were rejected",
+		[]string{"bucket", "key"}, nil,
+	)
+)
+
+// TextfileConfig configures the textfile prober, which serves the metrics in
+// the Prometheus text format files under a prefix
+type TextfileConfig struct {
+	// Suffix is what the keys of the files end with
+	Suffix string `yaml:"suffix,omitempty"`
+	// StaleAfter skips files that were last modified longer ago than this
+	StaleAfter model.Duration `yaml:"stale_after,omitempty"`
+	// MaxSize is the most bytes that will be read from each file
+	MaxSize int64 `yaml:"max_size,omitempty"`
+}
+
+// UnmarshalYAML sets the defaults for a textfile config and validates it
+func (c *TextfileConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain TextfileConfig
+	*c = TextfileConfig{
+		Suffix:  ".prom",
+		MaxSize: defaultContentMaxSize,
+	}
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("line %d: max_size must be positive", value.Line)
+	}
+	return nil
+}
+
+// textfileFamily is the metrics of the same name from every file, along with
+// the help and type they're exposed with
+type textfileFamily struct {
+	help    string
+	typ     dto.MetricType
+	metrics []*dto.Metric
+}
+
+// collectTextfiles lists the prefix and passes on the metrics in every text
+// format file found. The metrics can't be known up front, so the exporter
+// doesn't describe anything for this prober and the registry checks the
+// metrics as they're gathered instead.
+func (e *Exporter) collectTextfiles(ch chan<- prometheus.Metric) {
+	if e.prefix != e.prefixLabel {
+		ch <- prometheus.MustNewConstMetric(
+			s3ResolvedPrefix, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel, e.prefix,
+		)
+	}
+
+	conf := e.module.Textfile
+	start := time.Now()
+	b := &listBudget{
+		maxObjects: e.module.MaxObjects,
+		maxPages:   e.module.MaxPages,
+	}
+	result := &listResult{}
+	var files []objectInfo
+	query := listQuery{
+		Bucket: e.bucket,
+		Prefix: e.prefix,
+	}
+	err := e.listPages(e.ctx, query, b, result, func(page *listPage) bool {
+		for _, item := range page.Objects {
+			if !b.takeObject() {
+				result.truncated = true
+				return false
+			}
+			if strings.HasSuffix(item.Key, conf.Suffix) {
+				files = append(files, item)
+			}
+		}
+		return true
+	})
+	observeProbe(e.moduleName, start, err == nil)
+	if err != nil {
+		log.Errorln(err)
+		ch <- prometheus.MustNewConstMetric(
+			s3ListSuccess, prometheus.GaugeValue, 0, e.bucket, e.prefixLabel, "",
+		)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		s3ListSuccess, prometheus.GaugeValue, 1, e.bucket, e.prefixLabel, "",
+	)
+	ch <- prometheus.MustNewConstMetric(
+		s3ListDuration, prometheus.GaugeValue, time.Since(start).Seconds(), e.bucket, e.prefixLabel, "",
+	)
+	truncated := 0.0
+	if result.truncated {
+		truncated = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		s3ListTruncated, prometheus.GaugeValue, truncated, e.bucket, e.prefixLabel, "",
+	)
+
+	families := map[string]*textfileFamily{}
+	seen := map[string]bool{}
+	now := time.Now()
+	for _, item := range files {
+		key := item.Key
+		ch <- prometheus.MustNewConstMetric(
+			s3TextfileMtime, prometheus.GaugeValue, float64(item.LastModified.Unix()), e.bucket, key,
+		)
+
+		stale := conf.StaleAfter > 0 && now.Sub(item.LastModified) > time.Duration(conf.StaleAfter)
+		ch <- prometheus.MustNewConstMetric(
+			s3TextfileStale, prometheus.GaugeValue, boolToFloat(stale), e.bucket, key,
+		)
+		if stale {
+			continue
+		}
+
+		err := e.readTextfile(key, conf.MaxSize, families, seen)
+		if err != nil {
+			log.Errorf("skipping s3://%s/%s: %s", e.bucket, key, err)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			s3TextfileError, prometheus.GaugeValue, boolToFloat(err != nil), e.bucket, key,
+		)
+	}
+
+	for name, f := range families {
+		for _, m := range f.metrics {
+			metric, err := textfileMetric(name, f, m)
+			if err != nil {
+				log.Errorf("skipping a series of %s: %s", name, err)
+				continue
+			}
+			ch <- metric
+		}
+	}
+}
+
+// readTextfile parses a text format file and adds its metrics to families
+// with the bucket and key labels. Nothing from the file is added if any of
+// it conflicts with what's already there.
+func (e *Exporter) readTextfile(key string, maxSize int64, families map[string]*textfileFamily, seen map[string]bool) error {
+	b, err := e.readObject(key, "", maxSize)
+	if err != nil {
+		return err
+	}
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(parsed))
+	for name := range parsed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	added := map[string]bool{}
+	for _, name := range names {
+		mf := parsed[name]
+		if strings.HasPrefix(name, namespace+"_") {
+			return fmt.Errorf("metric %s is in the exporter's own %s_ namespace", name, namespace)
+		}
+		if f, ok := families[name]; ok && f.typ != mf.GetType() {
+			return fmt.Errorf("metric %s is a %s, but it's a %s in another file", name, mf.GetType(), f.typ)
+		}
+		for _, m := range mf.Metric {
+			if m.TimestampMs != nil {
+				return fmt.Errorf("metric %s has a timestamp, which isn't supported", name)
+			}
+			for _, l := range m.Label {
+				if l.GetName() == "bucket" || l.GetName() == "key" {
+					return fmt.Errorf("metric %s already has a %s label", name, l.GetName())
+				}
+			}
+			m.Label = append(m.Label,
+				&dto.LabelPair{Name: aws.String("bucket"), Value: aws.String(e.bucket)},
+				&dto.LabelPair{Name: aws.String("key"), Value: aws.String(key)},
+			)
+			id := seriesID(name, m.Label)
+			if seen[id] || added[id] {
+				return fmt.Errorf("metric %s has duplicate series", name)
+			}
+			added[id] = true
+		}
+	}
+
+	for id := range added {
+		seen[id] = true
+	}
+	for _, name := range names {
+		mf := parsed[name]
+		f, ok := families[name]
+		if !ok {
+			f = &textfileFamily{help: mf.GetHelp(), typ: mf.GetType()}
+			families[name] = f
+		}
+		f.metrics = append(f.metrics, mf.Metric...)
+	}
+	return nil
+}
+
+// seriesID identifies a series by its name and labels, in any order
+func seriesID(name string, labels []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.GetName()+"="+l.GetValue())
+	}
+	sort.Strings(pairs)
+	return name + "\xff" + strings.Join(pairs, "\xff")
+}
+
+// textfileMetric turns a parsed series back into a metric that can be
+// collected
+func textfileMetric(name string, f *textfileFamily, m *dto.Metric) (prometheus.Metric, error) {
+	names := make([]string, 0, len(m.Label))
+	values := make([]string, 0, len(m.Label))
+	for _, l := range m.Label {
+		names = append(names, l.GetName())
+		values = append(values, l.GetValue())
+	}
+	desc := prometheus.NewDesc(name, f.help, names, nil)
+
+	switch f.typ {
+	case dto.MetricType_COUNTER:
+		return prometheus.NewConstMetric(desc, prometheus.CounterValue, m.GetCounter().GetValue(), values...)
+	case dto.MetricType_GAUGE:
+		return prometheus.NewConstMetric(desc, prometheus.GaugeValue, m.GetGauge().GetValue(), values...)
+	case dto.MetricType_SUMMARY:
+		quantiles := map[float64]float64{}
+		for _, q := range m.GetSummary().GetQuantile() {
+			quantiles[q.GetQuantile()] = q.GetValue()
+		}
+		return prometheus.NewConstSummary(desc, m.GetSummary().GetSampleCount(), m.GetSummary().GetSampleSum(), quantiles, values...)
+	case dto.MetricType_HISTOGRAM:
+		buckets := map[float64]uint64{}
+		for _, b := range m.GetHistogram().GetBucket() {
+			buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+		}
+		return prometheus.NewConstHistogram(desc, m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum(), buckets, values...)
+	default:
+		return prometheus.NewConstMetric(desc, prometheus.UntypedValue, m.GetUntyped().GetValue(), values...)
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
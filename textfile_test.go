@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// TestProbeHandlerTextfile checks that the metrics in text format files are
+// merged, and that stale files and files that conflict are skipped
+func TestProbeHandlerTextfile(t *testing.T) {
+	bodies := map[string]string{
+		"metrics/a.prom": `# HELP job_runs_total Runs of the job.
+# TYPE job_runs_total counter
+job_runs_total{job="a"} 3
+# TYPE job_last_success gauge
+job_last_success{job="a"} 1792112400
+# TYPE job_duration_seconds histogram
+job_duration_seconds_bucket{le="1"} 1
+job_duration_seconds_bucket{le="10"} 3
+job_duration_seconds_bucket{le="+Inf"} 3
+job_duration_seconds_sum 12
+job_duration_seconds_count 3
+`,
+		"metrics/b.prom": `# TYPE job_last_success gauge
+job_last_success{job="b"} 1792026000
+`,
+		"metrics/conflict.prom": `# TYPE job_runs_total gauge
+job_runs_total{job="c"} 1
+`,
+		"metrics/dup.prom": `job_other{job="d"} 1
+job_other{job="d"} 2
+`,
+		"metrics/labelled.prom": `job_other{key="x"} 1
+`,
+		"metrics/old.prom": `job_old 1
+`,
+		"metrics/readme.txt": `not metrics`,
+	}
+	var objects []*s3.Object
+	contents := map[string][]byte{}
+	for key, body := range bodies {
+		modified := time.Now()
+		if key == "metrics/old.prom" {
+			modified = modified.Add(-2 * time.Hour)
+		}
+		objects = append(objects, &s3.Object{
+			Key:          aws.String(key),
+			LastModified: aws.Time(modified),
+			Size:         aws.Int64(int64(len(body))),
+		})
+		contents[key] = []byte(body)
+	}
+	svc := newMemS3Client(objects)
+	svc.bodies = contents
+
+	conf, err := parseConfig([]byte(`
+modules:
+  textfile:
+    prober: textfile
+    textfile:
+      stale_after: 1h
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/probe?bucket=mock&module=textfile&prefix=metrics/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, svc, conf, nil, 0)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected a 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	expected := []string{
+		`s3_list_success{bucket="mock",delimiter="",prefix="metrics/"} 1`,
+		`# HELP job_runs_total Runs of the job.`,
+		`# TYPE job_runs_total counter`,
+		`job_runs_total{bucket="mock",job="a",key="metrics/a.prom"} 3`,
+		`job_last_success{bucket="mock",job="a",key="metrics/a.prom"} 1.7921124e+09`,
+		`job_last_success{bucket="mock",job="b",key="metrics/b.prom"} 1.792026e+09`,
+		`job_duration_seconds_bucket{bucket="mock",key="metrics/a.prom",le="10"} 3`,
+		`job_duration_seconds_count{bucket="mock",key="metrics/a.prom"} 3`,
+		`s3_textfile_error{bucket="mock",key="metrics/a.prom"} 0`,
+		`s3_textfile_error{bucket="mock",key="metrics/conflict.prom"} 1`,
+		`s3_textfile_error{bucket="mock",key="metrics/dup.prom"} 1`,
+		`s3_textfile_error{bucket="mock",key="metrics/labelled.prom"} 1`,
+		`s3_textfile_stale{bucket="mock",key="metrics/old.prom"} 1`,
+		`s3_textfile_stale{bucket="mock",key="metrics/a.prom"} 0`,
+	}
+	for _, l := range expected {
+		if !strings.Contains(rr.Body.String(), l) {
+			t.Errorf("expected %s", l)
+		}
+	}
+	for _, l := range []string{`job="c"`, `job="d"`, "job_old", "readme.txt"} {
+		if strings.Contains(rr.Body.String(), l) {
+			t.Errorf("didn't expect %s", l)
+		}
+	}
+}